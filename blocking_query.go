@@ -0,0 +1,49 @@
+package main
+
+import (
+    "fmt"
+    "time"
+    
+    log "github.com/Sirupsen/logrus"
+)
+
+// returned by a watched query that has seen what it was waiting for
+var errStopWatching = fmt.Errorf("stop watching")
+
+// repeats a blocking query until done is closed or the query returns
+// errStopWatching.  the query is given the index returned by its last
+// successful call, starting at 0.  errors are logged as "<failure>: <error>",
+// and the query tried again after retryDelay so we don't hammer Consul.
+func watchBlockingQuery(done <-chan interface{}, retryDelay time.Duration, failure string, query func(waitIdx uint64) (uint64, error)) {
+    waitIdx := uint64(0)
+    
+    for {
+        select {
+            case <-done:
+                return
+            
+            default:
+        }
+        
+        nextIdx, err := query(waitIdx)
+        
+        if err == errStopWatching {
+            return
+        }
+        
+        if err != nil {
+            log.Errorf("%s: %v", failure, err)
+            
+            select {
+                case <-done:
+                    return
+                
+                case <-time.After(retryDelay):
+            }
+            
+            continue
+        }
+        
+        waitIdx = nextIdx
+    }
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "time"
+    "errors"
+)
+
+var _ = Describe("watchBlockingQuery", func() {
+    It("passes on each index and retries after errors", func(done Done) {
+        var indexes []uint64
+        
+        watchBlockingQuery(nil, time.Millisecond, "query failed", func(waitIdx uint64) (uint64, error) {
+            indexes = append(indexes, waitIdx)
+            
+            switch len(indexes) {
+                case 1:
+                    return 10, nil
+                
+                case 2:
+                    return 0, errors.New("no leader")
+                
+                case 3:
+                    return 11, nil
+            }
+            
+            return waitIdx, errStopWatching
+        })
+        
+        Expect(indexes).To(Equal([]uint64{ 0, 10, 10, 11 }))
+        
+        close(done)
+    })
+    
+    It("stops when told", func(done Done) {
+        stop := make(chan interface{})
+        close(stop)
+        
+        watchBlockingQuery(stop, time.Millisecond, "query failed", func(waitIdx uint64) (uint64, error) {
+            Fail("query shouldn't be made")
+            return 0, nil
+        })
+        
+        close(done)
+    })
+})
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "sort"
+    "strings"
+)
+
+// CheckStateExporter publishes the check states retrieved from Consul as
+// Prometheus gauges, so the same consolidated view sent to Riemann can be
+// scraped.  Each check gets one series per status, set to 1 for its current
+// status and 0 for the others.
+type CheckStateExporter struct {
+    gauge *Gauge
+}
+
+var consulStatuses = []string{ "passing", "warning", "critical" }
+
+func NewCheckStateExporter(registry *MetricsRegistry) *CheckStateExporter {
+    return &CheckStateExporter{
+        gauge: registry.NewGauge(
+            "consul_check_status",
+            "Status of a Consul health check, as seen by the receiver; 1 for the current status.",
+            "node", "service", "check_id", "status", "tags",
+        ),
+    }
+}
+
+func (self *CheckStateExporter) Name() string {
+    return "prometheus"
+}
+
+func (self *CheckStateExporter) Open() error {
+    return nil
+}
+
+// replaces the exported states with those in the results
+func (self *CheckStateExporter) Send(healthResults []HealthCheck) error {
+    var values []labeledValue
+    
+    for _, healthCheck := range healthResults {
+        // sort a copy of the tags so the series are stable
+        tags := append([]string(nil), healthCheck.Tags...)
+        sort.Strings(tags)
+        
+        for _, status := range consulStatuses {
+            value := 0.0
+            if healthCheck.Status == status {
+                value = 1
+            }
+            
+            values = append(values, labeledValue{
+                labelValues: []string{
+                    healthCheck.Node,
+                    healthCheck.ServiceName,
+                    healthCheck.CheckID,
+                    status,
+                    strings.Join(tags, ","),
+                },
+                value: value,
+            })
+        }
+    }
+    
+    self.gauge.ReplaceAll(values)
+    
+    return nil
+}
+
+// removes all exported states; called when we're no longer the leader and the
+// states would go stale
+func (self *CheckStateExporter) Close() {
+    self.gauge.Reset()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+    "bytes"
+)
+
+var _ = Describe("CheckStateExporter", func() {
+    var registry *MetricsRegistry
+    var exporter *CheckStateExporter
+    
+    BeforeEach(func() {
+        registry = NewMetricsRegistry()
+        exporter = NewCheckStateExporter(registry)
+    })
+    
+    render := func() string {
+        var buf bytes.Buffer
+        registry.Render(&buf)
+        
+        return buf.String()
+    }
+    
+    It("exports one series per status", func() {
+        exporter.Send([]HealthCheck{
+            HealthCheck{
+                Node:        "some-node",
+                CheckID:     "service:some-service",
+                Status:      "warning",
+                ServiceID:   "some-service",
+                ServiceName: "some-service",
+                Tags:        []string{ "tag2", "tag1" },
+            },
+        })
+        
+        output := render()
+        
+        labels := `node="some-node",service="some-service",check_id="service:some-service"`
+        Expect(output).To(ContainSubstring(`consul_check_status{` + labels + `,status="passing",tags="tag1,tag2"} 0`))
+        Expect(output).To(ContainSubstring(`consul_check_status{` + labels + `,status="warning",tags="tag1,tag2"} 1`))
+        Expect(output).To(ContainSubstring(`consul_check_status{` + labels + `,status="critical",tags="tag1,tag2"} 0`))
+    })
+    
+    It("replaces previous results", func() {
+        exporter.Send([]HealthCheck{
+            HealthCheck{ Node: "old-node", CheckID: "serfHealth", Status: "passing" },
+        })
+        
+        exporter.Send([]HealthCheck{
+            HealthCheck{ Node: "new-node", CheckID: "serfHealth", Status: "passing" },
+        })
+        
+        output := render()
+        Expect(output).NotTo(ContainSubstring("old-node"))
+        Expect(output).To(ContainSubstring("new-node"))
+    })
+    
+    It("clears all results", func() {
+        exporter.Send([]HealthCheck{
+            HealthCheck{ Node: "some-node", CheckID: "serfHealth", Status: "passing" },
+        })
+        
+        exporter.Close()
+        
+        Expect(render()).NotTo(ContainSubstring("some-node"))
+    })
+})
@@ -0,0 +1,188 @@
+package main
+
+import (
+    "fmt"
+    "time"
+    "strings"
+    "encoding/json"
+    
+    "github.com/armon/consul-api"
+)
+
+// CheckStateStore keeps the time each check entered its current status in the
+// KV store, so a new leader can continue where the last one left off.  Each
+// node's checks are kept in their own key under the prefix, which is only
+// written when they change.
+//
+// writes are check-and-set against the index we last saw, and each value
+// carries the fencing token of the leader that wrote it, so a stale leader
+// can't overwrite what a newer one has saved.
+type CheckStateStore struct {
+    kv           ConsulKV
+    prefix       string
+    fencingToken func() uint64
+    
+    // ModifyIndex of each node's key when we last read or wrote it, and what
+    // we last wrote
+    indexes map[string]uint64
+    written map[string][]byte
+}
+
+// the status of a check and when it entered it
+type checkState struct {
+    Node    string
+    CheckID string
+    Status  string
+    Since   time.Time
+    
+    // the service name and TTL of the check's last event, so its final one
+    // replaces it in Riemann's index
+    Service string        `json:",omitempty"`
+    TTL     time.Duration `json:",omitempty"`
+}
+
+// the value of each node's key
+type nodeCheckStates struct {
+    FencingToken uint64
+    Checks       []checkState
+}
+
+func NewCheckStateStore(kv ConsulKV, prefix string, fencingToken func() uint64) *CheckStateStore {
+    return &CheckStateStore{
+        kv:           kv,
+        prefix:       strings.TrimSuffix(prefix, "/"),
+        fencingToken: fencingToken,
+        indexes:      make(map[string]uint64),
+        written:      make(map[string][]byte),
+    }
+}
+
+func (self *CheckStateStore) key(node string) string {
+    return self.prefix + "/" + node
+}
+
+// returns the stored states; empty if there aren't any yet
+func (self *CheckStateStore) Load() ([]checkState, error) {
+    start := time.Now()
+    pairs, queryMeta, err := self.kv.List(self.prefix + "/", nil)
+    observeConsulCall("kv_list", start, queryMeta, err)
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    self.indexes = make(map[string]uint64)
+    self.written = make(map[string][]byte)
+    
+    var states []checkState
+    
+    for _, kvp := range pairs {
+        node := strings.TrimPrefix(kvp.Key, self.prefix + "/")
+        self.indexes[node] = kvp.ModifyIndex
+        
+        var stored nodeCheckStates
+        if err := json.Unmarshal(kvp.Value, &stored); err != nil {
+            return nil, fmt.Errorf("invalid check states for %s: %v", node, err)
+        }
+        
+        states = append(states, stored.Checks...)
+    }
+    
+    return states, nil
+}
+
+// writes the keys of the nodes whose checks have changed.  the keys of nodes
+// that are gone are emptied rather than deleted, so that goes through the same
+// check-and-set and fencing as any other write.
+func (self *CheckStateStore) Save(states []checkState) error {
+    byNode := make(map[string][]checkState)
+    for _, state := range states {
+        byNode[state.Node] = append(byNode[state.Node], state)
+    }
+    
+    for node := range self.indexes {
+        if _, found := byNode[node]; !found {
+            byNode[node] = nil
+        }
+    }
+    
+    var errs []string
+    
+    for node, nodeStates := range byNode {
+        if err := self.saveNode(node, nodeStates); err != nil {
+            errs = append(errs, err.Error())
+        }
+    }
+    
+    if len(errs) > 0 {
+        return fmt.Errorf("%s", strings.Join(errs, "; "))
+    }
+    
+    return nil
+}
+
+func (self *CheckStateStore) saveNode(node string, states []checkState) error {
+    token := self.fencingToken()
+    
+    value, err := json.Marshal(nodeCheckStates{
+        FencingToken: token,
+        Checks:       states,
+    })
+    
+    if err != nil {
+        return err
+    }
+    
+    if string(value) == string(self.written[node]) {
+        return nil
+    }
+    
+    key := self.key(node)
+    
+    start := time.Now()
+    ok, _, err := self.kv.CAS(&consulapi.KVPair{
+        Key:         key,
+        Value:       value,
+        ModifyIndex: self.indexes[node],
+    }, nil)
+    observeConsulCall("kv_cas", start, nil, err)
+    
+    if err != nil {
+        return err
+    }
+    
+    // find out the key's new index, or who got there first
+    start = time.Now()
+    kvp, queryMeta, err := self.kv.Get(key, nil)
+    observeConsulCall("kv_get", start, queryMeta, err)
+    
+    if err != nil {
+        return err
+    }
+    
+    var index uint64
+    var stored nodeCheckStates
+    
+    if kvp != nil {
+        index = kvp.ModifyIndex
+        json.Unmarshal(kvp.Value, &stored)
+    }
+    
+    if ok {
+        self.indexes[node] = index
+        self.written[node] = value
+        
+        return nil
+    }
+    
+    delete(self.written, node)
+    
+    if stored.FencingToken > token {
+        return fmt.Errorf("check states for %s were saved by a newer leader", node)
+    }
+    
+    // an older leader's; ours replace them next time
+    self.indexes[node] = index
+    
+    return fmt.Errorf("check states for %s were changed by another instance", node)
+}
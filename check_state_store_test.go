@@ -0,0 +1,158 @@
+package main
+
+import (
+    "time"
+    "encoding/json"
+    
+    "github.com/stretchr/testify/mock"
+    "github.com/armon/consul-api"
+    "github.com/bluestatedigital/riemann-consul-receiver/consul-mocks"
+)
+
+var _ = Describe("CheckStateStore", func() {
+    var mockKV consulmocks.MockKV
+    var store  *CheckStateStore
+    var token  uint64
+    
+    prefix := "some/prefix"
+    since := time.Unix(1420070400, 0).UTC()
+    
+    var nilQueryOpts *consulapi.QueryOptions = nil
+    var nilWriteOpts *consulapi.WriteOptions = nil
+    
+    stored := func(token uint64, states ...checkState) []byte {
+        value, _ := json.Marshal(nodeCheckStates{ FencingToken: token, Checks: states })
+        return value
+    }
+    
+    BeforeEach(func() {
+        mockKV = consulmocks.MockKV{}
+        token = 5
+        store = NewCheckStateStore(&mockKV, prefix, func() uint64 { return token })
+    })
+    
+    It("loads nothing if there are no keys", func() {
+        mockKV.On("List", prefix + "/", nilQueryOpts).Return(nil, &consulapi.QueryMeta{}, nil)
+        
+        states, err := store.Load()
+        Expect(err).To(BeNil())
+        Expect(states).To(BeEmpty())
+    })
+    
+    It("loads the states of every node", func() {
+        node1 := checkState{ Node: "node1", CheckID: "serfHealth", Status: "critical", Since: since }
+        node2 := checkState{ Node: "node2", CheckID: "serfHealth", Status: "passing", Since: since }
+        
+        mockKV.On("List", prefix + "/", nilQueryOpts).Return(consulapi.KVPairs{
+            &consulapi.KVPair{ Key: prefix + "/node1", Value: stored(4, node1), ModifyIndex: 10 },
+            &consulapi.KVPair{ Key: prefix + "/node2", Value: stored(4, node2), ModifyIndex: 11 },
+        }, &consulapi.QueryMeta{}, nil)
+        
+        states, err := store.Load()
+        Expect(err).To(BeNil())
+        Expect(states).To(Equal([]checkState{ node1, node2 }))
+    })
+    
+    It("saves each node's states in its own key, with check-and-set", func() {
+        states := []checkState{
+            checkState{ Node: "node1", CheckID: "serfHealth", Status: "critical", Since: since },
+            checkState{ Node: "node1", CheckID: "service:redis", Status: "passing", Since: since },
+        }
+        
+        mockKV.On("CAS", mock.AnythingOfType("*consulapi.KVPair"), nilWriteOpts).Return(true, &consulapi.WriteMeta{}, nil)
+        mockKV.On("Get", prefix + "/node1", nilQueryOpts).Return(&consulapi.KVPair{ ModifyIndex: 12 }, &consulapi.QueryMeta{}, nil)
+        
+        Expect(store.Save(states)).To(BeNil())
+        
+        kvp := mockKV.Calls[0].Arguments.Get(0).(*consulapi.KVPair)
+        Expect(kvp.Key).To(Equal(prefix + "/node1"))
+        Expect(kvp.ModifyIndex).To(Equal(uint64(0)))
+        Expect(kvp.Value).To(Equal(stored(5, states...)))
+        
+        // unchanged, so not written again
+        Expect(store.Save(states)).To(BeNil())
+        Expect(mockKV.Calls).To(HaveLen(2))
+        
+        // changed, so written against the index we last saw
+        states[0].Status = "passing"
+        Expect(store.Save(states)).To(BeNil())
+        Expect(mockKV.Calls).To(HaveLen(4))
+        Expect(mockKV.Calls[2].Arguments.Get(0).(*consulapi.KVPair).ModifyIndex).To(Equal(uint64(12)))
+    })
+    
+    It("empties the keys of nodes that are gone, with check-and-set", func() {
+        mockKV.On("List", prefix + "/", nilQueryOpts).Return(consulapi.KVPairs{
+            &consulapi.KVPair{ Key: prefix + "/node1", Value: stored(4), ModifyIndex: 10 },
+        }, &consulapi.QueryMeta{}, nil)
+        mockKV.On("CAS", mock.AnythingOfType("*consulapi.KVPair"), nilWriteOpts).Return(true, &consulapi.WriteMeta{}, nil)
+        mockKV.On("Get", prefix + "/node1", nilQueryOpts).Return(&consulapi.KVPair{ ModifyIndex: 12 }, &consulapi.QueryMeta{}, nil)
+        
+        store.Load()
+        
+        Expect(store.Save(nil)).To(BeNil())
+        
+        kvp := mockKV.Calls[1].Arguments.Get(0).(*consulapi.KVPair)
+        Expect(kvp.Key).To(Equal(prefix + "/node1"))
+        Expect(kvp.ModifyIndex).To(Equal(uint64(10)))
+        Expect(kvp.Value).To(Equal(stored(5)))
+        
+        // already empty, so not written again
+        Expect(store.Save(nil)).To(BeNil())
+        Expect(mockKV.Calls).To(HaveLen(3))
+    })
+    
+    It("doesn't empty the key of a node a newer leader has saved", func() {
+        mockKV.On("List", prefix + "/", nilQueryOpts).Return(consulapi.KVPairs{
+            &consulapi.KVPair{ Key: prefix + "/node1", Value: stored(4), ModifyIndex: 10 },
+        }, &consulapi.QueryMeta{}, nil)
+        mockKV.On("CAS", mock.AnythingOfType("*consulapi.KVPair"), nilWriteOpts).Return(false, &consulapi.WriteMeta{}, nil)
+        mockKV.On("Get", prefix + "/node1", nilQueryOpts).Return(
+            &consulapi.KVPair{ Value: stored(6), ModifyIndex: 20 },
+            &consulapi.QueryMeta{},
+            nil,
+        )
+        
+        store.Load()
+        
+        err := store.Save(nil)
+        Expect(err).NotTo(BeNil())
+        Expect(err.Error()).To(ContainSubstring("newer leader"))
+    })
+    
+    It("doesn't overwrite the states of a newer leader", func() {
+        states := []checkState{
+            checkState{ Node: "node1", CheckID: "serfHealth", Status: "critical", Since: since },
+        }
+        
+        mockKV.On("CAS", mock.AnythingOfType("*consulapi.KVPair"), nilWriteOpts).Return(false, &consulapi.WriteMeta{}, nil)
+        mockKV.On("Get", prefix + "/node1", nilQueryOpts).Return(
+            &consulapi.KVPair{ Value: stored(6), ModifyIndex: 20 },
+            &consulapi.QueryMeta{},
+            nil,
+        )
+        
+        Expect(store.Save(states)).NotTo(BeNil())
+        
+        // still the index we last saw, so the next attempt fails too
+        Expect(store.Save(states)).NotTo(BeNil())
+        Expect(mockKV.Calls[2].Arguments.Get(0).(*consulapi.KVPair).ModifyIndex).To(Equal(uint64(0)))
+    })
+    
+    It("replaces the states of an older leader after a conflict", func() {
+        states := []checkState{
+            checkState{ Node: "node1", CheckID: "serfHealth", Status: "critical", Since: since },
+        }
+        
+        mockKV.On("CAS", mock.AnythingOfType("*consulapi.KVPair"), nilWriteOpts).Return(false, &consulapi.WriteMeta{}, nil).Once()
+        mockKV.On("CAS", mock.AnythingOfType("*consulapi.KVPair"), nilWriteOpts).Return(true, &consulapi.WriteMeta{}, nil)
+        mockKV.On("Get", prefix + "/node1", nilQueryOpts).Return(
+            &consulapi.KVPair{ Value: stored(3), ModifyIndex: 20 },
+            &consulapi.QueryMeta{},
+            nil,
+        )
+        
+        Expect(store.Save(states)).NotTo(BeNil())
+        Expect(store.Save(states)).To(BeNil())
+        Expect(mockKV.Calls[2].Arguments.Get(0).(*consulapi.KVPair).ModifyIndex).To(Equal(uint64(20)))
+    })
+})
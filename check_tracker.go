@@ -0,0 +1,189 @@
+package main
+
+import (
+    "time"
+)
+
+// CheckTracker remembers the recent history of each check across batches of
+// health results, so that checks that keep changing status can be reported as
+// flapping instead of forwarding every change, and so we know how long each
+// check has been in its current status.
+type CheckTracker struct {
+    checks map[nodeCheckKey]*trackedCheck
+    
+    // a check is flapping if it changes status at least flapThreshold times
+    // within flapWindow; disabled if either is zero
+    flapWindow    time.Duration
+    flapThreshold int
+}
+
+type trackedCheck struct {
+    Status string
+    
+    // when the check entered its current status, as far as we know
+    Since  time.Time
+    
+    // when the status changed, oldest first; only those within the flap
+    // window are kept
+    Transitions []time.Time
+    
+    // the service name and TTL of the check's events, for its final one
+    Service string
+    TTL     time.Duration
+}
+
+func NewCheckTracker(flapWindow time.Duration, flapThreshold int) *CheckTracker {
+    return &CheckTracker{
+        checks:        make(map[nodeCheckKey]*trackedCheck),
+        flapWindow:    flapWindow,
+        flapThreshold: flapThreshold,
+    }
+}
+
+// records the status of each check in the batch; returns true if any check
+// changed status or is new
+func (self *CheckTracker) Update(healthResults []HealthCheck, now time.Time) bool {
+    changed := false
+    
+    for _, healthCheck := range healthResults {
+        key := nodeCheckKey{ healthCheck.Node, healthCheck.CheckID }
+        
+        check, found := self.checks[key]
+        if ! found {
+            self.checks[key] = &trackedCheck{
+                Status: healthCheck.Status,
+                Since:  now,
+            }
+            
+            changed = true
+            continue
+        }
+        
+        if check.Status != healthCheck.Status {
+            check.Status = healthCheck.Status
+            check.Since = now
+            changed = true
+            
+            if self.flapWindow > 0 {
+                check.Transitions = append(check.Transitions, now)
+            }
+        }
+        
+        // forget transitions that have aged out of the window
+        cutoff := now.Add(-self.flapWindow)
+        for len(check.Transitions) > 0 && check.Transitions[0].Before(cutoff) {
+            check.Transitions = check.Transitions[1:]
+        }
+    }
+    
+    return changed
+}
+
+// records the service name and TTL the check's events are sent with; returns
+// true if they've changed
+func (self *CheckTracker) Label(healthCheck HealthCheck, service string, ttl time.Duration) bool {
+    check, found := self.checks[nodeCheckKey{ healthCheck.Node, healthCheck.CheckID }]
+    if ! found || (check.Service == service && check.TTL == ttl) {
+        return false
+    }
+    
+    check.Service = service
+    check.TTL = ttl
+    
+    return true
+}
+
+// returns the last known states of the checks that aren't in the batch, which
+// have been deregistered (or whose nodes have).  they're remembered until
+// Forget is called, so the final events for them can be tried again.
+func (self *CheckTracker) Vanished(healthResults []HealthCheck) []checkState {
+    present := make(map[nodeCheckKey]bool)
+    for _, healthCheck := range healthResults {
+        present[nodeCheckKey{ healthCheck.Node, healthCheck.CheckID }] = true
+    }
+    
+    var vanished []checkState
+    
+    for key, check := range self.checks {
+        if ! present[key] {
+            vanished = append(vanished, checkState{
+                Node:    key.Node,
+                CheckID: key.CheckID,
+                Status:  check.Status,
+                Since:   check.Since,
+                Service: check.Service,
+                TTL:     check.TTL,
+            })
+        }
+    }
+    
+    return vanished
+}
+
+// stops tracking the given checks
+func (self *CheckTracker) Forget(states []checkState) {
+    for _, state := range states {
+        delete(self.checks, nodeCheckKey{ state.Node, state.CheckID })
+    }
+}
+
+// returns when the check entered its current status
+func (self *CheckTracker) Since(healthCheck HealthCheck) (time.Time, bool) {
+    check, found := self.checks[nodeCheckKey{ healthCheck.Node, healthCheck.CheckID }]
+    if ! found {
+        return time.Time{}, false
+    }
+    
+    return check.Since, true
+}
+
+// the status of each check and when it entered it, for persisting
+func (self *CheckTracker) Snapshot() []checkState {
+    states := make([]checkState, 0, len(self.checks))
+    
+    for key, check := range self.checks {
+        states = append(states, checkState{
+            Node:    key.Node,
+            CheckID: key.CheckID,
+            Status:  check.Status,
+            Since:   check.Since,
+            Service: check.Service,
+            TTL:     check.TTL,
+        })
+    }
+    
+    return states
+}
+
+// picks up from a snapshot taken by a previous leader.  flap history isn't
+// carried over.
+func (self *CheckTracker) Restore(states []checkState) {
+    for _, state := range states {
+        self.checks[nodeCheckKey{ state.Node, state.CheckID }] = &trackedCheck{
+            Status:  state.Status,
+            Since:   state.Since,
+            Service: state.Service,
+            TTL:     state.TTL,
+        }
+    }
+}
+
+// returns the number of status changes within the flap window, and whether
+// that's enough for the check to be considered flapping
+func (self *CheckTracker) Flapping(healthCheck HealthCheck) (int, bool) {
+    if self.flapWindow == 0 || self.flapThreshold == 0 {
+        return 0, false
+    }
+    
+    check, found := self.checks[nodeCheckKey{ healthCheck.Node, healthCheck.CheckID }]
+    if ! found {
+        return 0, false
+    }
+    
+    return len(check.Transitions), len(check.Transitions) >= self.flapThreshold
+}
+
+// forgets everything; the next batch is treated as the first
+func (self *CheckTracker) Reset() {
+    self.checks = make(map[nodeCheckKey]*trackedCheck)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+    "time"
+)
+
+var _ = Describe("CheckTracker", func() {
+    var tracker *CheckTracker
+    var now time.Time
+    
+    check := HealthCheck{ Node: "node1", CheckID: "service:web" }
+    
+    // records the check with the given status, a minute after the last update
+    update := func(status string) {
+        now = now.Add(time.Minute)
+        
+        check.Status = status
+        tracker.Update([]HealthCheck{ check }, now)
+    }
+    
+    BeforeEach(func() {
+        tracker = NewCheckTracker(5 * time.Minute, 3)
+        now = time.Unix(1420070400, 0)
+    })
+    
+    It("isn't flapping with a stable status", func() {
+        update("passing")
+        update("passing")
+        update("passing")
+        
+        changes, flapping := tracker.Flapping(check)
+        Expect(changes).To(Equal(0))
+        Expect(flapping).To(Equal(false))
+    })
+    
+    It("is flapping after enough changes within the window", func() {
+        update("passing")
+        update("critical")
+        update("passing")
+        
+        _, flapping := tracker.Flapping(check)
+        Expect(flapping).To(Equal(false))
+        
+        update("critical")
+        
+        changes, flapping := tracker.Flapping(check)
+        Expect(changes).To(Equal(3))
+        Expect(flapping).To(Equal(true))
+    })
+    
+    It("stops flapping once the changes age out of the window", func() {
+        update("passing")
+        update("critical")
+        update("passing")
+        update("critical")
+        
+        for i := 0; i < 5; i++ {
+            update("critical")
+        }
+        
+        changes, flapping := tracker.Flapping(check)
+        Expect(changes).To(Equal(1))
+        Expect(flapping).To(Equal(false))
+    })
+    
+    It("forgets everything when reset", func() {
+        update("passing")
+        update("critical")
+        update("passing")
+        update("critical")
+        
+        tracker.Reset()
+        
+        _, flapping := tracker.Flapping(check)
+        Expect(flapping).To(Equal(false))
+    })
+    
+    It("is disabled without a window", func() {
+        tracker = NewCheckTracker(0, 0)
+        
+        update("passing")
+        update("critical")
+        update("passing")
+        update("critical")
+        
+        _, flapping := tracker.Flapping(check)
+        Expect(flapping).To(Equal(false))
+    })
+    
+    It("finds checks that have disappeared until they're forgotten", func() {
+        update("critical")
+        
+        vanished := tracker.Vanished([]HealthCheck{})
+        Expect(vanished).To(HaveLen(1))
+        Expect(vanished[0].CheckID).To(Equal("service:web"))
+        Expect(vanished[0].Status).To(Equal("critical"))
+        
+        Expect(tracker.Vanished([]HealthCheck{})).To(HaveLen(1))
+        
+        tracker.Forget(vanished)
+        Expect(tracker.Vanished([]HealthCheck{})).To(BeEmpty())
+        
+        _, found := tracker.Since(check)
+        Expect(found).To(Equal(false))
+    })
+    
+    It("keeps the service name and TTL of the check's events", func() {
+        update("critical")
+        
+        Expect(tracker.Label(check, "web", 10 * time.Minute)).To(Equal(true))
+        Expect(tracker.Label(check, "web", 10 * time.Minute)).To(Equal(false))
+        
+        snapshot := tracker.Snapshot()
+        Expect(snapshot).To(HaveLen(1))
+        Expect(snapshot[0].Service).To(Equal("web"))
+        Expect(snapshot[0].TTL).To(Equal(10 * time.Minute))
+        
+        restored := NewCheckTracker(0, 0)
+        restored.Restore(snapshot)
+        
+        vanished := restored.Vanished([]HealthCheck{})
+        Expect(vanished).To(HaveLen(1))
+        Expect(vanished[0].Service).To(Equal("web"))
+    })
+})
@@ -27,3 +27,22 @@ func (m *MockCatalog) Service(service, tag string, q *consulapi.QueryOptions) ([
 
     return svcs, qm, r2
 }
+
+func (m *MockCatalog) NodeMeta(q *consulapi.QueryOptions) (map[string]map[string]string, *consulapi.QueryMeta, error) {
+    ret := m.Called(q)
+
+    var meta map[string]map[string]string = nil
+    var qm *consulapi.QueryMeta = nil
+    
+    if ret.Get(0) != nil {
+        meta = ret.Get(0).(map[string]map[string]string)
+    }
+    
+    if ret.Get(1) != nil {
+        qm = ret.Get(1).(*consulapi.QueryMeta)
+    }
+
+    r2 := ret.Error(2)
+
+    return meta, qm, r2
+}
@@ -18,3 +18,22 @@ func (m *MockHealth) State(state string, q *consulapi.QueryOptions) ([]*consulap
 
     return r0, r1, r2
 }
+
+func (m *MockHealth) Service(service, tag string, passingOnly bool, q *consulapi.QueryOptions) ([]*consulapi.ServiceEntry, *consulapi.QueryMeta, error) {
+    ret := m.Called(service, tag, passingOnly, q)
+
+    var retEntries []*consulapi.ServiceEntry = nil
+    var retQm *consulapi.QueryMeta = nil
+    
+    if ret.Get(0) != nil {
+        retEntries = ret.Get(0).([]*consulapi.ServiceEntry)
+    }
+    
+    if ret.Get(1) != nil {
+        retQm = ret.Get(1).(*consulapi.QueryMeta)
+    }
+
+    r2 := ret.Error(2)
+
+    return retEntries, retQm, r2
+}
@@ -53,3 +53,52 @@ func (m *MockKV) Release(p *consulapi.KVPair, q *consulapi.WriteOptions) (bool,
 
     return r0, r1, r2
 }
+
+func (m *MockKV) Put(p *consulapi.KVPair, q *consulapi.WriteOptions) (*consulapi.WriteMeta, error) {
+    ret := m.Called(p, q)
+
+    var retWm *consulapi.WriteMeta = nil
+    
+    if ret.Get(0) != nil {
+        retWm = ret.Get(0).(*consulapi.WriteMeta)
+    }
+
+    r1 := ret.Error(1)
+
+    return retWm, r1
+}
+
+func (m *MockKV) CAS(p *consulapi.KVPair, q *consulapi.WriteOptions) (bool, *consulapi.WriteMeta, error) {
+    ret := m.Called(p, q)
+
+    r0 := ret.Get(0).(bool)
+    
+    var retWm *consulapi.WriteMeta = nil
+    
+    if ret.Get(1) != nil {
+        retWm = ret.Get(1).(*consulapi.WriteMeta)
+    }
+
+    r2 := ret.Error(2)
+
+    return r0, retWm, r2
+}
+
+func (m *MockKV) List(prefix string, q *consulapi.QueryOptions) (consulapi.KVPairs, *consulapi.QueryMeta, error) {
+    ret := m.Called(prefix, q)
+
+    var retPairs consulapi.KVPairs = nil
+    var retQm *consulapi.QueryMeta = nil
+    
+    if ret.Get(0) != nil {
+        retPairs = ret.Get(0).(consulapi.KVPairs)
+    }
+    
+    if ret.Get(1) != nil {
+        retQm = ret.Get(1).(*consulapi.QueryMeta)
+    }
+
+    r2 := ret.Error(2)
+
+    return retPairs, retQm, r2
+}
@@ -56,3 +56,22 @@ func (m *MockSession) Destroy(id string, q *consulapi.WriteOptions) (*consulapi.
 
     return r0, r1
 }
+
+func (m *MockSession) Renew(id string, q *consulapi.WriteOptions) (*consulapi.SessionEntry, *consulapi.WriteMeta, error) {
+    ret := m.Called(id, q)
+    
+    var retSess *consulapi.SessionEntry = nil
+    var retWm *consulapi.WriteMeta = nil
+    
+    if ret.Get(0) != nil {
+        retSess = ret.Get(0).(*consulapi.SessionEntry)
+    }
+    
+    if ret.Get(1) != nil {
+        retWm = ret.Get(1).(*consulapi.WriteMeta)
+    }
+    
+    r2 := ret.Error(2)
+
+    return retSess, retWm, r2
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+    "github.com/armon/consul-api"
+)
+
+// consulCatalog adds the catalog calls that consul-api doesn't have yet, made
+// directly against the HTTP API.
+type consulCatalog struct {
+    *consulapi.Catalog
+    
+    config *consulapi.Config
+}
+
+func newConsulCatalog(client *consulapi.Client, config *consulapi.Config) *consulCatalog {
+    return &consulCatalog{
+        Catalog: client.Catalog(),
+        config:  config,
+    }
+}
+
+// returns the metadata of each node (Consul 0.7.3 and later), keyed by node
+// name.  nodes without metadata, or registered with an older Consul, have
+// empty maps.
+func (self *consulCatalog) NodeMeta(q *consulapi.QueryOptions) (map[string]map[string]string, *consulapi.QueryMeta, error) {
+    var nodes []struct {
+        Node string
+        Meta map[string]string
+    }
+    
+    queryMeta, err := consulGet(self.config, "/v1/catalog/nodes", q, &nodes)
+    if err != nil {
+        return nil, nil, err
+    }
+    
+    meta := make(map[string]map[string]string)
+    for _, node := range nodes {
+        if node.Meta == nil {
+            node.Meta = make(map[string]string)
+        }
+        
+        meta[node.Node] = node.Meta
+    }
+    
+    return meta, queryMeta, nil
+}
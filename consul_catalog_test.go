@@ -0,0 +1,67 @@
+package main
+
+import (
+    "time"
+    "strings"
+    "net/http"
+    "net/http/httptest"
+
+    "github.com/armon/consul-api"
+)
+
+var _ = Describe("consulCatalog", func() {
+    var server *httptest.Server
+    var request *http.Request
+    var catalog *consulCatalog
+    
+    BeforeEach(func() {
+        server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            request = r
+            
+            w.Header().Set("X-Consul-Index", "42")
+            w.Header().Set("X-Consul-KnownLeader", "true")
+            w.Header().Set("X-Consul-LastContact", "5")
+            
+            w.Write([]byte(`[
+                {"Node": "node1", "Address": "10.0.0.1", "Meta": {"rack": "r1", "az": "us-east-1a"}},
+                {"Node": "node2", "Address": "10.0.0.2"}
+            ]`))
+        }))
+        
+        config := &consulapi.Config{
+            Address:    strings.TrimPrefix(server.URL, "http://"),
+            Scheme:     "http",
+            Datacenter: "dc1",
+        }
+        
+        client, err := consulapi.NewClient(config)
+        Expect(err).To(BeNil())
+        
+        catalog = newConsulCatalog(client, config)
+    })
+    
+    AfterEach(func() {
+        server.Close()
+    })
+    
+    It("retrieves node metadata", func() {
+        meta, queryMeta, err := catalog.NodeMeta(&consulapi.QueryOptions{
+            WaitIndex: 10,
+            WaitTime:  time.Minute,
+        })
+        
+        Expect(err).To(BeNil())
+        Expect(request.URL.Path).To(Equal("/v1/catalog/nodes"))
+        Expect(request.URL.Query().Get("index")).To(Equal("10"))
+        Expect(request.URL.Query().Get("wait")).To(Equal("60000ms"))
+        Expect(request.URL.Query().Get("dc")).To(Equal("dc1"))
+        
+        Expect(meta).To(HaveLen(2))
+        Expect(meta["node1"]).To(HaveKeyWithValue("az", "us-east-1a"))
+        Expect(meta["node2"]).To(BeEmpty())
+        
+        Expect(queryMeta.LastIndex).To(Equal(uint64(42)))
+        Expect(queryMeta.KnownLeader).To(Equal(true))
+        Expect(queryMeta.LastContact).To(Equal(5 * time.Millisecond))
+    })
+})
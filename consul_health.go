@@ -0,0 +1,150 @@
+package main
+
+import (
+    "time"
+    "encoding/json"
+
+    "github.com/armon/consul-api"
+)
+
+// what kind of check it is and how it's run, as far as Consul tells us.
+// Consul 1.0 added the type and 1.4 the definition; with older versions
+// these are empty.
+type CheckDetails struct {
+    // http, tcp, ttl, script, docker, grpc, etc.
+    CheckType string
+    Interval  string
+    Timeout   string
+    
+    // the URL or address probed by http, tcp and grpc checks
+    Target    string
+}
+
+// implemented by ConsulHealth implementations that can also return each
+// check's type and definition along with it
+type detailedConsulHealth interface {
+    DetailedState(state string, q *consulapi.QueryOptions) ([]*consulHealthCheck, *consulapi.QueryMeta, error)
+}
+
+// consulHealth adds a version of State that returns the check type and
+// definition, which consul-api's HealthCheck doesn't have, made directly
+// against the HTTP API.
+type consulHealth struct {
+    *consulapi.Health
+    
+    config *consulapi.Config
+}
+
+// a health check as returned by newer versions of Consul
+type consulHealthCheck struct {
+    consulapi.HealthCheck
+    
+    Type       string
+    Definition struct {
+        HTTP     string
+        TCP      string
+        GRPC     string
+        Interval consulDuration
+        Timeout  consulDuration
+    }
+}
+
+// durations are encoded as strings like "10s" by current versions of Consul,
+// and as nanoseconds by some older ones
+type consulDuration string
+
+func (self *consulDuration) UnmarshalJSON(data []byte) error {
+    var str string
+    if err := json.Unmarshal(data, &str); err == nil {
+        *self = consulDuration(str)
+        return nil
+    }
+    
+    var nanos int64
+    if err := json.Unmarshal(data, &nanos); err != nil {
+        return err
+    }
+    
+    if nanos == 0 {
+        *self = ""
+    } else {
+        *self = consulDuration(time.Duration(nanos).String())
+    }
+    
+    return nil
+}
+
+func newConsulHealth(client *consulapi.Client, config *consulapi.Config) *consulHealth {
+    return &consulHealth{
+        Health: client.Health(),
+        config: config,
+    }
+}
+
+// returns the checks in the given state, as /v1/health/state/<state> does
+func (self *consulHealth) DetailedState(state string, q *consulapi.QueryOptions) ([]*consulHealthCheck, *consulapi.QueryMeta, error) {
+    var checks []*consulHealthCheck
+    
+    queryMeta, err := consulGet(self.config, "/v1/health/state/" + state, q, &checks)
+    if err != nil {
+        return nil, nil, err
+    }
+    
+    return checks, queryMeta, nil
+}
+
+func (self *consulHealthCheck) details() CheckDetails {
+    details := CheckDetails{
+        CheckType: self.Type,
+        Interval:  string(self.Definition.Interval),
+        Timeout:   string(self.Definition.Timeout),
+    }
+    
+    switch {
+        case self.Definition.HTTP != "":
+            details.Target = self.Definition.HTTP
+            
+            if details.CheckType == "" {
+                details.CheckType = "http"
+            }
+        
+        case self.Definition.TCP != "":
+            details.Target = self.Definition.TCP
+            
+            if details.CheckType == "" {
+                details.CheckType = "tcp"
+            }
+        
+        case self.Definition.GRPC != "":
+            details.Target = self.Definition.GRPC
+            
+            if details.CheckType == "" {
+                details.CheckType = "grpc"
+            }
+    }
+    
+    // serfHealth has never had a type
+    if details.CheckType == "" && self.CheckID == "serfHealth" {
+        details.CheckType = "serf"
+    }
+    
+    return details
+}
+
+// the attributes for an event about the check
+func (self CheckDetails) attributes() map[string]string {
+    attributes := make(map[string]string)
+    
+    for name, value := range map[string]string{
+        "check_type":     self.CheckType,
+        "check_interval": self.Interval,
+        "check_timeout":  self.Timeout,
+        "check_target":   self.Target,
+    } {
+        if value != "" {
+            attributes[name] = value
+        }
+    }
+    
+    return attributes
+}
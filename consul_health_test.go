@@ -0,0 +1,79 @@
+package main
+
+import (
+    "strings"
+    "net/http"
+    "net/http/httptest"
+
+    "github.com/armon/consul-api"
+)
+
+var _ = Describe("consulHealth", func() {
+    var server *httptest.Server
+    var request *http.Request
+    var health *consulHealth
+    var body string
+    
+    BeforeEach(func() {
+        server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            request = r
+            
+            w.Header().Set("X-Consul-Index", "42")
+            w.Write([]byte(body))
+        }))
+        
+        config := &consulapi.Config{
+            Address: strings.TrimPrefix(server.URL, "http://"),
+        }
+        
+        client, err := consulapi.NewClient(config)
+        Expect(err).To(BeNil())
+        
+        health = newConsulHealth(client, config)
+    })
+    
+    AfterEach(func() {
+        server.Close()
+    })
+    
+    It("retrieves checks with their details", func() {
+        body = `[
+            {"Node": "node1", "CheckID": "serfHealth", "Status": "passing"},
+            {"Node": "node1", "CheckID": "service:web", "Status": "critical", "ServiceID": "web", "ServiceName": "web",
+             "Type": "http", "Definition": {"HTTP": "http://localhost:8080/health", "Interval": "10s", "Timeout": "5s"}},
+            {"Node": "node1", "CheckID": "service:db", "Status": "passing", "ServiceID": "db", "ServiceName": "db",
+             "Definition": {"TCP": "localhost:5432", "Interval": 30000000000}},
+            {"Node": "node1", "CheckID": "service:batch", "Status": "passing", "ServiceID": "batch", "ServiceName": "batch", "Type": "ttl"}
+        ]`
+        
+        checks, queryMeta, err := health.DetailedState("any", nil)
+        
+        Expect(err).To(BeNil())
+        Expect(request.URL.Path).To(Equal("/v1/health/state/any"))
+        Expect(queryMeta.LastIndex).To(Equal(uint64(42)))
+        Expect(checks).To(HaveLen(4))
+        Expect(checks[1].ServiceName).To(Equal("web"))
+        Expect(checks[1].Status).To(Equal("critical"))
+        
+        Expect(checks[1].details()).To(Equal(CheckDetails{
+            CheckType: "http",
+            Interval:  "10s",
+            Timeout:   "5s",
+            Target:    "http://localhost:8080/health",
+        }))
+        
+        details := checks[2].details()
+        Expect(details.CheckType).To(Equal("tcp"))
+        Expect(details.Interval).To(Equal("30s"))
+        Expect(details.Target).To(Equal("localhost:5432"))
+        
+        Expect(checks[3].details().CheckType).To(Equal("ttl"))
+        Expect(checks[0].details().CheckType).To(Equal("serf"))
+    })
+    
+    It("omits empty details from event attributes", func() {
+        attributes := CheckDetails{ CheckType: "ttl" }.attributes()
+        
+        Expect(attributes).To(Equal(map[string]string{ "check_type": "ttl" }))
+    })
+})
@@ -0,0 +1,77 @@
+package main
+
+import (
+    "fmt"
+    "time"
+    "net/url"
+    "net/http"
+    "strconv"
+    "encoding/json"
+
+    "github.com/armon/consul-api"
+)
+
+// makes a GET request against Consul's HTTP API and decodes the JSON response
+// into out, for the calls where consul-api doesn't expose everything we need.
+// handles the datacenter, token and blocking query parameters the same way
+// consul-api does.
+func consulGet(config *consulapi.Config, path string, q *consulapi.QueryOptions, out interface{}) (*consulapi.QueryMeta, error) {
+    params := url.Values{}
+    
+    if config.Datacenter != "" {
+        params.Set("dc", config.Datacenter)
+    }
+    
+    if config.Token != "" {
+        params.Set("token", config.Token)
+    }
+    
+    if q != nil {
+        if q.WaitIndex != 0 {
+            params.Set("index", strconv.FormatUint(q.WaitIndex, 10))
+        }
+        
+        if q.WaitTime != 0 {
+            params.Set("wait", fmt.Sprintf("%dms", q.WaitTime / time.Millisecond))
+        }
+    }
+    
+    scheme := config.Scheme
+    if scheme == "" {
+        scheme = "http"
+    }
+    
+    httpClient := config.HttpClient
+    if httpClient == nil {
+        httpClient = http.DefaultClient
+    }
+    
+    start := time.Now()
+    resp, err := httpClient.Get(fmt.Sprintf("%s://%s%s?%s", scheme, config.Address, path, params.Encode()))
+    if err != nil {
+        return nil, err
+    }
+    
+    defer resp.Body.Close()
+    
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("unexpected response code: %d", resp.StatusCode)
+    }
+    
+    queryMeta := &consulapi.QueryMeta{
+        RequestTime: time.Since(start),
+    }
+    
+    queryMeta.LastIndex, _ = strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+    queryMeta.KnownLeader = resp.Header.Get("X-Consul-KnownLeader") == "true"
+    
+    if lastContact, err := strconv.ParseUint(resp.Header.Get("X-Consul-LastContact"), 10, 64); err == nil {
+        queryMeta.LastContact = time.Duration(lastContact) * time.Millisecond
+    }
+    
+    if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+        return nil, err
+    }
+    
+    return queryMeta, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+    "io"
+    "sync"
+    "encoding/json"
+    
+    "github.com/amir/raidman"
+)
+
+// EventPrinter is a RiemannClient that writes each event to w as a line of
+// JSON instead of sending it anywhere.
+type EventPrinter struct {
+    lock sync.Mutex
+    w    io.Writer
+}
+
+func NewEventPrinter(w io.Writer) *EventPrinter {
+    return &EventPrinter{
+        w: w,
+    }
+}
+
+func (self *EventPrinter) Send(evt *raidman.Event) error {
+    line, err := json.Marshal(evt)
+    if err != nil {
+        return err
+    }
+    
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    
+    _, err = self.w.Write(append(line, '\n'))
+    
+    return err
+}
+
+// nothing to close; w belongs to the caller
+func (self *EventPrinter) Close() {
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+    "bytes"
+    "strings"
+    "encoding/json"
+
+    "github.com/amir/raidman"
+)
+
+var _ = Describe("EventPrinter", func() {
+    It("writes each event as a line of JSON", func() {
+        var buf bytes.Buffer
+        printer := NewEventPrinter(&buf)
+        
+        Expect(printer.Send(&raidman.Event{ Host: "node1", Service: "web", State: "ok" })).To(BeNil())
+        Expect(printer.Send(&raidman.Event{ Host: "node2", Service: "web", State: "critical" })).To(BeNil())
+        
+        lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+        Expect(lines).To(HaveLen(2))
+        
+        var evt raidman.Event
+        Expect(json.Unmarshal([]byte(lines[1]), &evt)).To(BeNil())
+        Expect(evt.Host).To(Equal("node2"))
+        Expect(evt.State).To(Equal("critical"))
+    })
+})
@@ -0,0 +1,83 @@
+package main
+
+import (
+    "os"
+    "time"
+    "encoding/json"
+)
+
+// FileSink appends each health check to a file as a line of JSON.
+type FileSink struct {
+    path     string
+    nodeName string
+    dc       string
+    file     *os.File
+}
+
+// one line in the file
+type fileSinkRecord struct {
+    Time          time.Time
+    ReportingNode string
+    Datacenter    string
+    HealthCheck
+}
+
+func NewFileSink(path, nodeName, dc string) *FileSink {
+    return &FileSink{
+        path:     path,
+        nodeName: nodeName,
+        dc:       dc,
+    }
+}
+
+func (self *FileSink) Name() string {
+    return "file"
+}
+
+func (self *FileSink) Open() error {
+    if self.file != nil {
+        return nil
+    }
+    
+    file, err := os.OpenFile(self.path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+    if err != nil {
+        return err
+    }
+    
+    self.file = file
+    
+    return nil
+}
+
+func (self *FileSink) Send(healthResults []HealthCheck) error {
+    if err := self.Open(); err != nil {
+        return err
+    }
+    
+    now := time.Now()
+    encoder := json.NewEncoder(self.file)
+    
+    for _, healthCheck := range healthResults {
+        err := encoder.Encode(fileSinkRecord{
+            Time:          now,
+            ReportingNode: self.nodeName,
+            Datacenter:    self.dc,
+            HealthCheck:   healthCheck,
+        })
+        
+        if err != nil {
+            // reopen next time, in case the file was rotated out from under us
+            self.Close()
+            return err
+        }
+    }
+    
+    return nil
+}
+
+func (self *FileSink) Close() {
+    if self.file != nil {
+        self.file.Close()
+        self.file = nil
+    }
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+    "os"
+    "bufio"
+    "io/ioutil"
+    "encoding/json"
+)
+
+var _ = Describe("FileSink", func() {
+    var tmpDir string
+    var path   string
+    var sink   *FileSink
+    
+    healthResults := []HealthCheck{
+        HealthCheck{ Node: "node1", CheckID: "serfHealth", Status: "passing" },
+        HealthCheck{ Node: "node2", CheckID: "serfHealth", Status: "critical", Output: "Agent not live" },
+    }
+    
+    readRecords := func() []fileSinkRecord {
+        file, err := os.Open(path)
+        Expect(err).To(BeNil())
+        defer file.Close()
+        
+        var records []fileSinkRecord
+        
+        scanner := bufio.NewScanner(file)
+        for scanner.Scan() {
+            var record fileSinkRecord
+            Expect(json.Unmarshal(scanner.Bytes(), &record)).To(BeNil())
+            
+            records = append(records, record)
+        }
+        
+        return records
+    }
+    
+    BeforeEach(func() {
+        var err error
+        
+        tmpDir, err = ioutil.TempDir("", "file-sink")
+        Expect(err).To(BeNil())
+        
+        path = tmpDir + "/results.json"
+        sink = NewFileSink(path, "reporter", "dc1")
+    })
+    
+    AfterEach(func() {
+        sink.Close()
+        os.RemoveAll(tmpDir)
+    })
+    
+    It("writes each health check as a line of JSON", func() {
+        Expect(sink.Open()).To(BeNil())
+        Expect(sink.Send(healthResults)).To(BeNil())
+        
+        records := readRecords()
+        Expect(records).To(HaveLen(2))
+        
+        Expect(records[1].ReportingNode).To(Equal("reporter"))
+        Expect(records[1].Datacenter).To(Equal("dc1"))
+        Expect(records[1].Node).To(Equal("node2"))
+        Expect(records[1].Status).To(Equal("critical"))
+        Expect(records[1].Output).To(Equal("Agent not live"))
+    })
+    
+    It("appends to an existing file", func() {
+        Expect(sink.Send(healthResults)).To(BeNil())
+        sink.Close()
+        
+        sink = NewFileSink(path, "reporter", "dc1")
+        Expect(sink.Send(healthResults[:1])).To(BeNil())
+        
+        Expect(readRecords()).To(HaveLen(3))
+    })
+    
+    It("fails to open a file in a missing directory", func() {
+        sink = NewFileSink(tmpDir + "/missing/results.json", "reporter", "dc1")
+        
+        Expect(sink.Open()).NotTo(BeNil())
+        Expect(sink.Send(healthResults)).NotTo(BeNil())
+    })
+})
@@ -18,6 +18,9 @@ type HealthCheck struct {
     ServiceID   string
     ServiceName string
     Tags        []string
+    
+    // empty unless the ConsulHealth implementation provides them
+    CheckDetails
 }
 
 type nodeServiceKey struct {
@@ -57,10 +60,13 @@ func (self *HealthChecker) WatchHealthResults(done <-chan interface{}) <-chan []
             // refactor when https://github.com/hashicorp/consul/issues/377 lands
             serviceDetails := make(map[string]map[nodeServiceKey]*consulapi.CatalogService)
 
-            healthChecks, queryMeta, err := self.health.State("any", &consulapi.QueryOptions{
+            start := time.Now()
+            healthChecks, details, queryMeta, err := self.state(&consulapi.QueryOptions{
                 WaitIndex: waitIdx,
                 WaitTime:  self.updateInterval,
             })
+            observeConsulCall("health_state", start, queryMeta, err)
+            observeBlockingQuery("health_state", waitIdx, queryMeta)
             
             if err != nil {
                 log.Errorf("error retrieving health results: %v", err)
@@ -73,7 +79,7 @@ func (self *HealthChecker) WatchHealthResults(done <-chan interface{}) <-chan []
             log.Debug("handling health check results")
             
             var results []HealthCheck
-            for _, hc := range healthChecks {
+            for i, hc := range healthChecks {
                 result := HealthCheck{
                     Node:        hc.Node,
                     CheckID:     hc.CheckID,
@@ -85,10 +91,16 @@ func (self *HealthChecker) WatchHealthResults(done <-chan interface{}) <-chan []
                     ServiceName: hc.ServiceName,
                 }
                 
+                if details != nil {
+                    result.CheckDetails = details[i]
+                }
+                
                 if hc.ServiceID != "" {
                     if _, exists := serviceDetails[hc.ServiceName]; ! exists {
                         // retrieve the service details; don't already have them
+                        start := time.Now()
                         svcDetails, _, err := self.catalog.Service(hc.ServiceName, "", nil)
+                        observeConsulCall("catalog_service", start, nil, err)
                         
                         if err != nil {
                             // break out of the HealthCheck iteration loop if an
@@ -141,3 +153,29 @@ func (self *HealthChecker) WatchHealthResults(done <-chan interface{}) <-chan []
     
     return resultsChan
 }
+
+// retrieves every check, and if the ConsulHealth implementation can tell us,
+// the details of each from the same response; nil otherwise
+func (self *HealthChecker) state(q *consulapi.QueryOptions) ([]*consulapi.HealthCheck, []CheckDetails, *consulapi.QueryMeta, error) {
+    detailed, ok := self.health.(detailedConsulHealth)
+    if ! ok {
+        healthChecks, queryMeta, err := self.health.State("any", q)
+        return healthChecks, nil, queryMeta, err
+    }
+    
+    checks, queryMeta, err := detailed.DetailedState("any", q)
+    if err != nil {
+        return nil, nil, queryMeta, err
+    }
+    
+    healthChecks := make([]*consulapi.HealthCheck, 0, len(checks))
+    details := make([]CheckDetails, 0, len(checks))
+    
+    for _, check := range checks {
+        healthCheck := check.HealthCheck
+        healthChecks = append(healthChecks, &healthCheck)
+        details = append(details, check.details())
+    }
+    
+    return healthChecks, details, queryMeta, nil
+}
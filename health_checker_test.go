@@ -9,6 +9,17 @@ import (
     "github.com/bluestatedigital/riemann-consul-receiver/consul-mocks"
 )
 
+// a ConsulHealth that also returns the details of its checks
+type detailedMockHealth struct {
+    consulmocks.MockHealth
+}
+
+func (self *detailedMockHealth) DetailedState(state string, q *consulapi.QueryOptions) ([]*consulHealthCheck, *consulapi.QueryMeta, error) {
+    ret := self.Called(state, q)
+    
+    return ret.Get(0).([]*consulHealthCheck), ret.Get(1).(*consulapi.QueryMeta), ret.Error(2)
+}
+
 var _ = Describe("health checker", func() {
     var mockHealth    consulmocks.MockHealth
     var mockCatalog   consulmocks.MockCatalog
@@ -308,4 +319,46 @@ var _ = Describe("health checker", func() {
         // test's done *bing!*
         close(done)
     })
+    
+    It("includes check details when available", func(done Done) {
+        check := &consulHealthCheck{
+            HealthCheck: consulapi.HealthCheck{
+                Node:    nodeName,
+                CheckID: "service:web",
+                Status:  "passing",
+            },
+            Type: "http",
+        }
+        
+        check.Definition.HTTP = "http://localhost/"
+        check.Definition.Interval = "10s"
+        
+        detailedHealth := &detailedMockHealth{}
+        detailedHealth.On("DetailedState", "any", genericQueryOpts).Return(
+            []*consulHealthCheck{ check },
+            &consulapi.QueryMeta{
+                LastIndex: 10,
+            },
+            nil,
+        )
+        
+        healthChecker = NewHealthChecker(detailedHealth, &mockCatalog, updateInterval)
+        
+        d := make(chan interface{})
+        c := healthChecker.WatchHealthResults(d)
+        
+        results := <-c
+        Expect(results).To(HaveLen(1))
+        Expect(results[0].CheckType).To(Equal("http"))
+        Expect(results[0].Interval).To(Equal("10s"))
+        Expect(results[0].Target).To(Equal("http://localhost/"))
+        
+        close(d)
+        
+        // drain until the watcher stops
+        for _ = range c {
+        }
+        
+        close(done)
+    })
 })
@@ -0,0 +1,132 @@
+package main
+
+import (
+    "time"
+
+    "github.com/armon/consul-api"
+)
+
+// the receiver's internal metrics, served on /metrics
+var metrics = NewMetricsRegistry()
+
+var (
+    metricEventsSent = metrics.NewCounter(
+        "riemann_consul_receiver_events_sent_total",
+        "Events sent to Riemann via TCP and acknowledged.",
+    )
+    
+    metricUDPEventsAttempted = metrics.NewCounter(
+        "riemann_consul_receiver_udp_events_attempted_total",
+        "Events sent to Riemann via UDP, which Riemann doesn't acknowledge.",
+    )
+    
+    metricEventsFailed = metrics.NewCounter(
+        "riemann_consul_receiver_events_failed_total",
+        "Events that could not be sent to Riemann.",
+    )
+    
+    metricOversizedEvents = metrics.NewCounter(
+        "riemann_consul_receiver_oversized_events_total",
+        "Events too large for a UDP datagram, sent via TCP instead.",
+    )
+    
+    metricUnacknowledgedEvents = metrics.NewCounter(
+        "riemann_consul_receiver_unacknowledged_events_total",
+        "Events sent via TCP that Riemann did not acknowledge.",
+    )
+    
+    metricSinkBatches = metrics.NewCounter(
+        "riemann_consul_receiver_sink_batches_total",
+        "Batches of health results handed to each sink.",
+        "sink",
+    )
+    
+    metricSinkErrors = metrics.NewCounter(
+        "riemann_consul_receiver_sink_errors_total",
+        "Errors opening or sending to each sink.",
+        "sink",
+    )
+    
+    metricConsulDuration = metrics.NewHistogram(
+        "riemann_consul_receiver_consul_request_duration_seconds",
+        "Latency of Consul API calls, including time spent blocking.",
+        DefaultLatencyBuckets,
+        "call",
+    )
+    
+    metricConsulErrors = metrics.NewCounter(
+        "riemann_consul_receiver_consul_request_errors_total",
+        "Consul API calls that returned an error.",
+        "call",
+    )
+    
+    metricBlockingQueryIndexLag = metrics.NewGauge(
+        "riemann_consul_receiver_blocking_query_index_lag",
+        "Index returned by the last blocking query, less the index it waited on.",
+        "call",
+    )
+    
+    metricBlockingQueryLastContact = metrics.NewGauge(
+        "riemann_consul_receiver_blocking_query_last_contact_seconds",
+        "Time since the server answering a blocking query last heard from the Consul leader.",
+        "call",
+    )
+    
+    metricLockAcquisitions = metrics.NewCounter(
+        "riemann_consul_receiver_lock_acquisitions_total",
+        "Times this instance acquired the lock.",
+    )
+    
+    metricLockLosses = metrics.NewCounter(
+        "riemann_consul_receiver_lock_losses_total",
+        "Times this instance gave up or lost the lock, by transition type.",
+        "type",
+    )
+    
+    metricLeader = metrics.NewGauge(
+        "riemann_consul_receiver_leader",
+        "1 if this instance holds the lock, 0 otherwise.",
+    )
+)
+
+// make sure unlabeled metrics are reported before anything happens
+func init() {
+    metricEventsSent.Add(0)
+    metricUDPEventsAttempted.Add(0)
+    metricEventsFailed.Add(0)
+    metricOversizedEvents.Add(0)
+    metricUnacknowledgedEvents.Add(0)
+    metricLockAcquisitions.Add(0)
+    metricLeader.Set(0)
+}
+
+// records the outcome of a Consul API call that started at the given time.
+// queryMeta may be nil.
+func observeConsulCall(call string, start time.Time, queryMeta *consulapi.QueryMeta, err error) {
+    metricConsulDuration.Observe(time.Since(start).Seconds(), call)
+    
+    if err != nil {
+        metricConsulErrors.Inc(call)
+        return
+    }
+    
+    if queryMeta != nil {
+        metricBlockingQueryLastContact.Set(queryMeta.LastContact.Seconds(), call)
+    }
+}
+
+// records how far a blocking query that waited on waitIdx moved on.  the first
+// query of a watch doesn't wait, and an index that went backwards (a restored
+// snapshot, say) has no meaningful lag, so both are left out.
+func observeBlockingQuery(call string, waitIdx uint64, queryMeta *consulapi.QueryMeta) {
+    if waitIdx == 0 || queryMeta == nil {
+        return
+    }
+    
+    lag := float64(0)
+    if queryMeta.LastIndex > waitIdx {
+        lag = float64(queryMeta.LastIndex - waitIdx)
+    }
+    
+    metricBlockingQueryIndexLag.Set(lag, call)
+}
@@ -10,6 +10,9 @@ type RiemannClient interface {
     Close()
 }
 
+// opens a new connection to Riemann
+type RiemannDialer func() (RiemannClient, error)
+
 type ConsulAgent interface {
     Self() (map[string]map[string]interface{}, error)
     ServiceRegister(service *consulapi.AgentServiceRegistration) error
@@ -21,18 +24,30 @@ type ConsulSession interface {
     Create(se *consulapi.SessionEntry, q *consulapi.WriteOptions) (string, *consulapi.WriteMeta, error)
     Info(id string, q *consulapi.QueryOptions) (*consulapi.SessionEntry, *consulapi.QueryMeta, error)
     Destroy(id string, q *consulapi.WriteOptions) (*consulapi.WriteMeta, error)
+    Renew(id string, q *consulapi.WriteOptions) (*consulapi.SessionEntry, *consulapi.WriteMeta, error)
 }
 
 type ConsulKV interface {
     Acquire(p *consulapi.KVPair, q *consulapi.WriteOptions) (bool, *consulapi.WriteMeta, error)
     Get(key string, q *consulapi.QueryOptions) (*consulapi.KVPair, *consulapi.QueryMeta, error)
     Release(p *consulapi.KVPair, q *consulapi.WriteOptions) (bool, *consulapi.WriteMeta, error)
+    Put(p *consulapi.KVPair, q *consulapi.WriteOptions) (*consulapi.WriteMeta, error)
+    CAS(p *consulapi.KVPair, q *consulapi.WriteOptions) (bool, *consulapi.WriteMeta, error)
+    List(prefix string, q *consulapi.QueryOptions) (consulapi.KVPairs, *consulapi.QueryMeta, error)
 }
 
 type ConsulHealth interface {
     State(state string, q *consulapi.QueryOptions) ([]*consulapi.HealthCheck, *consulapi.QueryMeta, error)
 }
 
+// the instances of a service and their checks; see lock_priority.go
+type ConsulServiceHealth interface {
+    Service(service, tag string, passingOnly bool, q *consulapi.QueryOptions) ([]*consulapi.ServiceEntry, *consulapi.QueryMeta, error)
+}
+
 type ConsulCatalog interface {
     Service(service, tag string, q *consulapi.QueryOptions) ([]*consulapi.CatalogService, *consulapi.QueryMeta, error)
+    
+    // not in consul-api; see consul_catalog.go
+    NodeMeta(q *consulapi.QueryOptions) (map[string]map[string]string, *consulapi.QueryMeta, error)
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+    "sync"
+    "time"
+    "net/http"
+)
+
+const (
+    TransitionAcquired         = "acquired"
+    TransitionLost             = "lost"
+    TransitionReleased         = "released"
+    TransitionSessionRecreated = "session_recreated"
+)
+
+type LeadershipTransition struct {
+    Time         time.Time
+    Type         string
+    Reason       string
+    Session      string
+    FencingToken uint64
+}
+
+// LeadershipHistory keeps the most recent leadership transitions in memory so
+// flaps can be reconstructed without trawling the logs of every node.
+type LeadershipHistory struct {
+    lock        sync.RWMutex
+    limit       int
+    transitions []LeadershipTransition
+    listeners   []func(LeadershipTransition)
+}
+
+func NewLeadershipHistory(limit int) *LeadershipHistory {
+    return &LeadershipHistory{
+        limit: limit,
+    }
+}
+
+// registers a function to be invoked for every transition recorded after this
+// call.  listeners are invoked in their own goroutine so they may block.
+func (self *LeadershipHistory) OnTransition(listener func(LeadershipTransition)) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    
+    self.listeners = append(self.listeners, listener)
+}
+
+func (self *LeadershipHistory) Record(transition LeadershipTransition) {
+    if transition.Time.IsZero() {
+        transition.Time = time.Now()
+    }
+    
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    
+    self.transitions = append(self.transitions, transition)
+    
+    // drop the oldest
+    if len(self.transitions) > self.limit {
+        self.transitions = self.transitions[len(self.transitions) - self.limit:]
+    }
+    
+    for _, listener := range self.listeners {
+        go listener(transition)
+    }
+}
+
+// returns a copy of the recorded transitions, oldest first
+func (self *LeadershipHistory) Transitions() []LeadershipTransition {
+    self.lock.RLock()
+    defer self.lock.RUnlock()
+    
+    transitions := make([]LeadershipTransition, len(self.transitions))
+    copy(transitions, self.transitions)
+    
+    return transitions
+}
+
+func (self *LeadershipHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, self.Transitions())
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "fmt"
+)
+
+var _ = Describe("LeadershipHistory", func() {
+    var history *LeadershipHistory
+    
+    BeforeEach(func() {
+        history = NewLeadershipHistory(3)
+    })
+    
+    It("keeps transitions in order", func() {
+        history.Record(LeadershipTransition{ Type: TransitionAcquired })
+        history.Record(LeadershipTransition{ Type: TransitionLost })
+        
+        transitions := history.Transitions()
+        Expect(transitions).To(HaveLen(2))
+        Expect(transitions[0].Type).To(Equal(TransitionAcquired))
+        Expect(transitions[0].Time.IsZero()).To(Equal(false))
+        Expect(transitions[1].Type).To(Equal(TransitionLost))
+    })
+    
+    It("discards the oldest transitions", func() {
+        for i := 0; i < 5; i++ {
+            history.Record(LeadershipTransition{ Reason: fmt.Sprintf("%d", i) })
+        }
+        
+        transitions := history.Transitions()
+        Expect(transitions).To(HaveLen(3))
+        Expect(transitions[0].Reason).To(Equal("2"))
+        Expect(transitions[2].Reason).To(Equal("4"))
+    })
+    
+    It("notifies listeners", func(done Done) {
+        c := make(chan LeadershipTransition)
+        
+        history.OnTransition(func(transition LeadershipTransition) {
+            c <- transition
+        })
+        
+        history.Record(LeadershipTransition{ Type: TransitionReleased, Reason: "shutting down" })
+        
+        transition := <-c
+        Expect(transition.Type).To(Equal(TransitionReleased))
+        Expect(transition.Reason).To(Equal("shutting down"))
+        
+        close(done)
+    })
+})
@@ -0,0 +1,199 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    "strings"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/armon/consul-api"
+    "github.com/amir/raidman"
+)
+
+// LockAuditor periodically cross-checks our idea of who holds the lock against
+// Consul: the session holding the lock key, the node that session belongs to,
+// and the nodes where the receiver service is registered.  Disagreement
+// indicates a split-brain (two instances think they're the leader) or a lock
+// held by something that isn't going to send events.
+//
+// the service registrations are only checked if the instances register
+// themselves; in ttl session mode without priorities they don't.
+type LockAuditor struct {
+    lockWatcher *LockWatcher
+    kv          ConsulKV
+    session     ConsulSession
+    catalog     ConsulCatalog
+    registered  bool
+    notifier    *Notifier
+    interval    time.Duration
+
+    statusLock sync.RWMutex
+    lastAudit  time.Time
+    anomalies  []string
+}
+
+func NewLockAuditor(
+    lockWatcher *LockWatcher,
+    kv          ConsulKV,
+    session     ConsulSession,
+    catalog     ConsulCatalog,
+    registered  bool,
+    notifier    *Notifier,
+    interval    time.Duration,
+) *LockAuditor {
+    return &LockAuditor{
+        lockWatcher: lockWatcher,
+        kv:          kv,
+        session:     session,
+        catalog:     catalog,
+        registered:  registered,
+        notifier:    notifier,
+        interval:    interval,
+    }
+}
+
+// compares the lock holder with the session and service registrations.
+// returns a description of each anomaly found; an error is only returned if
+// Consul couldn't be queried.
+func (self *LockAuditor) Audit() ([]string, error) {
+    var anomalies []string
+    
+    start := time.Now()
+    kvp, queryMeta, err := self.kv.Get(self.lockWatcher.KeyPath(), nil)
+    observeConsulCall("lock_get", start, queryMeta, err)
+    if err != nil {
+        return nil, fmt.Errorf("unable to retrieve key %s: %v", self.lockWatcher.KeyPath(), err)
+    }
+    
+    holder := ""
+    if kvp != nil {
+        holder = kvp.Session
+    }
+    
+    ourSession := self.lockWatcher.SessionID()
+    haveLock := self.lockWatcher.HaveLock()
+    
+    if haveLock && holder != ourSession {
+        if holder == "" {
+            anomalies = append(anomalies, "this instance believes it holds the lock, but the lock is not held")
+        } else {
+            anomalies = append(anomalies, fmt.Sprintf("this instance believes it holds the lock, but it is held by session %s", holder))
+        }
+    }
+    
+    if ! haveLock && holder != "" && holder == ourSession {
+        anomalies = append(anomalies, "the lock is held by this instance's session, but this instance is not acting as leader")
+    }
+    
+    if holder != "" {
+        sessionEntry, _, err := self.session.Info(holder, nil)
+        if err != nil {
+            return nil, fmt.Errorf("unable to retrieve session %s: %v", holder, err)
+        }
+        
+        if sessionEntry == nil {
+            anomalies = append(anomalies, fmt.Sprintf("the lock is held by session %s, which no longer exists", holder))
+        } else if self.registered {
+            instances, _, err := self.catalog.Service(self.lockWatcher.ServiceName(), "", nil)
+            if err != nil {
+                return nil, fmt.Errorf("unable to retrieve %s instances: %v", self.lockWatcher.ServiceName(), err)
+            }
+            
+            if ! serviceRegisteredOnNode(instances, sessionEntry.Node) {
+                anomalies = append(anomalies, fmt.Sprintf(
+                    "the lock is held by session %s on node %s, which is not running %s",
+                    holder, sessionEntry.Node, self.lockWatcher.ServiceName(),
+                ))
+            }
+        }
+    }
+    
+    return anomalies, nil
+}
+
+func serviceRegisteredOnNode(instances []*consulapi.CatalogService, node string) bool {
+    for _, instance := range instances {
+        if instance.Node == node {
+            return true
+        }
+    }
+    
+    return false
+}
+
+// audits the lock every interval until the done channel is closed.  a warning
+// event is sent when anomalies are found, and an ok event once they clear.
+func (self *LockAuditor) Run(done <-chan interface{}) {
+    defer recoverAndLog("LockAuditor")
+    
+    for {
+        select {
+            case <-done:
+                return
+            
+            case <-time.After(self.interval):
+        }
+        
+        anomalies, err := self.Audit()
+        if err != nil {
+            log.Errorf("unable to audit lock: %v", err)
+            continue
+        }
+        
+        self.statusLock.Lock()
+        hadAnomalies := len(self.anomalies) > 0
+        self.lastAudit = time.Now()
+        self.anomalies = anomalies
+        self.statusLock.Unlock()
+        
+        for _, anomaly := range anomalies {
+            log.Warnf("lock anomaly: %s", anomaly)
+        }
+        
+        if len(anomalies) > 0 || hadAnomalies {
+            self.notify(anomalies)
+        }
+    }
+}
+
+func (self *LockAuditor) notify(anomalies []string) {
+    if self.notifier == nil {
+        return
+    }
+    
+    state := "ok"
+    if len(anomalies) > 0 {
+        state = "warning"
+    }
+    
+    err := self.notifier.Notify(&raidman.Event{
+        Service:     self.lockWatcher.ServiceName() + " lock",
+        State:       state,
+        Metric:      len(anomalies),
+        Description: strings.Join(anomalies, "\n"),
+        Attributes:  map[string]string{
+            "session": self.lockWatcher.SessionID(),
+        },
+    })
+    
+    if err != nil {
+        log.Errorf("unable to send lock audit event: %v", err)
+    }
+}
+
+// used for the status endpoint
+func (self *LockAuditor) Status() interface{} {
+    self.statusLock.RLock()
+    defer self.statusLock.RUnlock()
+    
+    anomalies := self.anomalies
+    if anomalies == nil {
+        anomalies = []string{}
+    }
+    
+    return map[string]interface{}{
+        "last_audit": self.lastAudit,
+        "anomalies":  anomalies,
+    }
+}
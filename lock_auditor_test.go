@@ -0,0 +1,183 @@
+package main
+
+import (
+    "time"
+
+    "github.com/stretchr/testify/mock"
+    "github.com/armon/consul-api"
+    "github.com/bluestatedigital/riemann-consul-receiver/consul-mocks"
+)
+
+var _ = Describe("LockAuditor", func() {
+    var auditor     *LockAuditor
+    var lockWatcher *LockWatcher
+    
+    var mockAgent   consulmocks.MockAgent
+    var mockSession consulmocks.MockSession
+    var mockKV      consulmocks.MockKV
+    var mockCatalog consulmocks.MockCatalog
+    
+    serviceName := "some-service"
+    keyName     := "some/key"
+    nodeName    := "some-node"
+    sessionID   := "42"
+    
+    var nilQueryOpts *consulapi.QueryOptions = nil
+    
+    BeforeEach(func() {
+        var err error
+        
+        mockAgent = consulmocks.MockAgent{}
+        mockAgent.On("Self").Return(
+            map[string]map[string]interface{}{
+                "Config": map[string]interface{}{
+                    "NodeName": nodeName,
+                },
+            },
+            nil,
+        )
+        
+        lockWatcher, err = NewLockWatcher(
+            &mockAgent,
+            &mockSession,
+            &mockKV,
+            new(consulmocks.MockHealth),
+            time.Minute,
+            time.Second * 15,
+            serviceName,
+            keyName,
+        )
+        
+        Expect(err).To(BeNil())
+        
+        lockWatcher.setSessionID(sessionID)
+        
+        mockSession = consulmocks.MockSession{}
+        mockKV      = consulmocks.MockKV{}
+        mockCatalog = consulmocks.MockCatalog{}
+        
+        auditor = NewLockAuditor(lockWatcher, &mockKV, &mockSession, &mockCatalog, true, nil, time.Minute)
+    })
+    
+    lockHeldBy := func(session string) {
+        mockKV.On("Get", keyName, nilQueryOpts).Return(
+            &consulapi.KVPair{
+                Key:     keyName,
+                Session: session,
+            },
+            new(consulapi.QueryMeta),
+            nil,
+        )
+    }
+    
+    sessionOnNode := func(session, node string) {
+        mockSession.On("Info", session, nilQueryOpts).Return(
+            &consulapi.SessionEntry{
+                ID:   session,
+                Node: node,
+                Name: serviceName,
+            },
+            new(consulapi.QueryMeta),
+            nil,
+        )
+    }
+    
+    serviceOnNodes := func(nodes ...string) {
+        var instances []*consulapi.CatalogService
+        for _, node := range nodes {
+            instances = append(instances, &consulapi.CatalogService{
+                Node:        node,
+                ServiceID:   serviceName,
+                ServiceName: serviceName,
+            })
+        }
+        
+        mockCatalog.On("Service", serviceName, "", mock.Anything).Return(
+            instances,
+            new(consulapi.QueryMeta),
+            nil,
+        )
+    }
+    
+    It("finds nothing wrong when we hold the lock", func() {
+        lockWatcher.setHaveLock(true)
+        
+        lockHeldBy(sessionID)
+        sessionOnNode(sessionID, nodeName)
+        serviceOnNodes(nodeName, "other-node")
+        
+        anomalies, err := auditor.Audit()
+        
+        Expect(err).To(BeNil())
+        Expect(anomalies).To(BeEmpty())
+        
+        mockKV.AssertExpectations(GinkgoT())
+        mockSession.AssertExpectations(GinkgoT())
+        mockCatalog.AssertExpectations(GinkgoT())
+    })
+    
+    It("finds nothing wrong when another instance holds the lock", func() {
+        lockHeldBy("other-session")
+        sessionOnNode("other-session", "other-node")
+        serviceOnNodes(nodeName, "other-node")
+        
+        anomalies, err := auditor.Audit()
+        
+        Expect(err).To(BeNil())
+        Expect(anomalies).To(BeEmpty())
+    })
+    
+    It("detects two instances believing they are leader", func() {
+        lockWatcher.setHaveLock(true)
+        
+        lockHeldBy("other-session")
+        sessionOnNode("other-session", "other-node")
+        serviceOnNodes(nodeName, "other-node")
+        
+        anomalies, err := auditor.Audit()
+        
+        Expect(err).To(BeNil())
+        Expect(anomalies).To(HaveLen(1))
+        Expect(anomalies[0]).To(ContainSubstring("held by session other-session"))
+    })
+    
+    It("detects a lock held by a session that no longer exists", func() {
+        lockHeldBy("other-session")
+        mockSession.On("Info", "other-session", nilQueryOpts).Return(
+            nil,
+            new(consulapi.QueryMeta),
+            nil,
+        )
+        
+        anomalies, err := auditor.Audit()
+        
+        Expect(err).To(BeNil())
+        Expect(anomalies).To(HaveLen(1))
+        Expect(anomalies[0]).To(ContainSubstring("no longer exists"))
+    })
+    
+    It("detects a lock held by a node not running the receiver", func() {
+        lockHeldBy("other-session")
+        sessionOnNode("other-session", "rogue-node")
+        serviceOnNodes(nodeName, "other-node")
+        
+        anomalies, err := auditor.Audit()
+        
+        Expect(err).To(BeNil())
+        Expect(anomalies).To(HaveLen(1))
+        Expect(anomalies[0]).To(ContainSubstring("rogue-node"))
+    })
+    
+    It("doesn't look for the receiver on the holder's node in ttl mode, where instances aren't registered", func() {
+        auditor = NewLockAuditor(lockWatcher, &mockKV, &mockSession, &mockCatalog, false, nil, time.Minute)
+        
+        lockHeldBy("other-session")
+        sessionOnNode("other-session", "other-node")
+        
+        anomalies, err := auditor.Audit()
+        
+        Expect(err).To(BeNil())
+        Expect(anomalies).To(BeEmpty())
+        Expect(mockCatalog.Calls).To(BeEmpty())
+    })
+})
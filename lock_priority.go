@@ -0,0 +1,235 @@
+package main
+
+import (
+    "fmt"
+    "time"
+    "strings"
+    "strconv"
+    "encoding/json"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/armon/consul-api"
+)
+
+// Preferred-leader priority.  Each instance advertises its priority in a
+// "priority=N" tag on its service registration.  When the lock is free, an
+// instance waits one lock delay for each distinct priority above its own
+// before trying to acquire it, giving preferred instances the first shot.
+// When the lock is held by an instance with a lower priority, a
+// higher-priority instance acquires the step-down key with its own session;
+// the leader watches that key and releases the lock gracefully.  Tying the
+// request to the requester's session means a request from an instance that has
+// since died is ignored.
+
+type stepDownRequest struct {
+    Node     string
+    Priority int
+}
+
+// enables preferred-leader priority; higher values are preferred.  must be
+// called before RegisterService.
+func (self *LockWatcher) UsePriority(priority int, serviceHealth ConsulServiceHealth) {
+    self.priority = priority
+    self.serviceHealth = serviceHealth
+}
+
+func priorityTag(priority int) string {
+    return fmt.Sprintf("priority=%d", priority)
+}
+
+// returns the priority from a service's tags; 0 if it isn't tagged
+func parsePriorityTag(tags []string) int {
+    for _, tag := range tags {
+        if strings.HasPrefix(tag, "priority=") {
+            priority, err := strconv.Atoi(strings.TrimPrefix(tag, "priority="))
+            
+            if err == nil {
+                return priority
+            }
+        }
+    }
+    
+    return 0
+}
+
+func (self *LockWatcher) stepDownKeyPath() string {
+    return self.keyPath + "/step-down"
+}
+
+// returns the priority of each node running the service whose checks are
+// passing; an instance that's down can't take the lock, so isn't waited for
+func (self *LockWatcher) instancePriorities() (map[string]int, error) {
+    instances, _, err := self.serviceHealth.Service(self.serviceName, "", true, nil)
+    
+    if err != nil {
+        return nil, fmt.Errorf("unable to retrieve %s instances: %v", self.serviceName, err)
+    }
+    
+    priorities := make(map[string]int)
+    for _, instance := range instances {
+        priorities[instance.Node.Node] = parsePriorityTag(instance.Service.Tags)
+    }
+    
+    return priorities, nil
+}
+
+// returns true if we should hold off acquiring the free lock so that a
+// higher-priority instance can take it first.
+func (self *LockWatcher) deferToHigherPriority() bool {
+    if self.serviceHealth == nil {
+        return false
+    }
+    
+    if self.unlockedSince.IsZero() {
+        self.unlockedSince = time.Now()
+    }
+    
+    priorities, err := self.instancePriorities()
+    if err != nil {
+        // better to have a leader than not
+        log.Error(err)
+        return false
+    }
+    
+    // count the distinct priorities above ours
+    levels := make(map[int]bool)
+    for _, priority := range priorities {
+        if priority > self.priority {
+            levels[priority] = true
+        }
+    }
+    
+    delay := self.lockDelay * time.Duration(len(levels))
+    
+    if time.Since(self.unlockedSince) < delay {
+        log.Debugf("deferring lock acquisition to %d higher priorities", len(levels))
+        return true
+    }
+    
+    return false
+}
+
+// asks the instance holding the lock with the given session to step down, if
+// its priority is lower than ours.
+func (self *LockWatcher) requestStepDown(holder string) {
+    if self.serviceHealth == nil || holder == self.stepDownRequested {
+        return
+    }
+    
+    sessionEntry, _, err := self.session.Info(holder, nil)
+    if err != nil {
+        log.Errorf("unable to retrieve session %s: %v", holder, err)
+        return
+    }
+    
+    if sessionEntry == nil {
+        // gone; the lock will be free soon enough
+        return
+    }
+    
+    priorities, err := self.instancePriorities()
+    if err != nil {
+        log.Error(err)
+        return
+    }
+    
+    if priorities[sessionEntry.Node] >= self.priority {
+        return
+    }
+    
+    value, err := json.Marshal(stepDownRequest{
+        Node:     self.nodeName,
+        Priority: self.priority,
+    })
+    
+    if err != nil {
+        log.Errorf("unable to encode step-down request: %v", err)
+        return
+    }
+    
+    start := time.Now()
+    requested, _, err := self.kv.Acquire(&consulapi.KVPair{
+        Key:     self.stepDownKeyPath(),
+        Session: self.SessionID(),
+        Value:   value,
+    }, nil)
+    observeConsulCall("step_down_acquire", start, nil, err)
+    
+    if err != nil {
+        log.Errorf("unable to request step-down: %v", err)
+        return
+    }
+    
+    if requested {
+        log.Infof("requested that %s (priority %d) step down", sessionEntry.Node, priorities[sessionEntry.Node])
+        self.stepDownRequested = holder
+    }
+}
+
+// releases our step-down request, if any, once we've got the lock.
+func (self *LockWatcher) withdrawStepDownRequest() {
+    if self.stepDownRequested == "" {
+        return
+    }
+    
+    self.stepDownRequested = ""
+    
+    start := time.Now()
+    _, _, err := self.kv.Release(&consulapi.KVPair{
+        Key:     self.stepDownKeyPath(),
+        Session: self.SessionID(),
+    }, nil)
+    observeConsulCall("step_down_release", start, nil, err)
+    
+    if err != nil {
+        log.Errorf("unable to withdraw step-down request: %v", err)
+    }
+}
+
+// returns a channel that is closed when a higher-priority instance asks us to
+// step down.  returns nil if priority is disabled.  stops watching when the
+// abort channel is closed.
+func (self *LockWatcher) WatchStepDown(abort <-chan interface{}) <-chan interface{} {
+    if self.serviceHealth == nil {
+        return nil
+    }
+    
+    stepDownChan := make(chan interface{})
+    
+    go watchBlockingQuery(abort, self.lockDelay, "unable to check step-down key", func(waitIdx uint64) (uint64, error) {
+        start := time.Now()
+        kvp, queryMeta, err := self.kv.Get(self.stepDownKeyPath(), &consulapi.QueryOptions{
+            WaitIndex: waitIdx,
+            WaitTime:  self.updateInterval,
+        })
+        observeConsulCall("step_down_watch", start, queryMeta, err)
+        observeBlockingQuery("step_down_watch", waitIdx, queryMeta)
+        
+        if err != nil {
+            return waitIdx, err
+        }
+        
+        // the request's only valid while the requester's session holds the
+        // key
+        if kvp == nil || kvp.Session == "" || kvp.Session == self.SessionID() {
+            return queryMeta.LastIndex, nil
+        }
+        
+        var request stepDownRequest
+        if err := json.Unmarshal(kvp.Value, &request); err != nil {
+            log.Errorf("invalid step-down request: %v", err)
+            return queryMeta.LastIndex, nil
+        }
+        
+        if request.Priority > self.priority {
+            log.Infof("%s (priority %d) requested that we step down", request.Node, request.Priority)
+            
+            close(stepDownChan)
+            return queryMeta.LastIndex, errStopWatching
+        }
+        
+        return queryMeta.LastIndex, nil
+    })
+    
+    return stepDownChan
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+    "time"
+    "encoding/json"
+
+    "github.com/stretchr/testify/mock"
+    "github.com/armon/consul-api"
+    "github.com/bluestatedigital/riemann-consul-receiver/consul-mocks"
+)
+
+var _ = Describe("preferred-leader priority", func() {
+    var receiver *LockWatcher
+    
+    var mockAgent         consulmocks.MockAgent
+    var mockSession       consulmocks.MockSession
+    var mockKV            consulmocks.MockKV
+    var mockServiceHealth consulmocks.MockHealth
+    
+    serviceName := "some-service"
+    keyName     := "some/key"
+    stepDownKey := "some/key/step-down"
+    nodeName    := "some-node"
+    sessionID   := "42"
+    
+    updateInterval := time.Minute
+    lockDelay := time.Second * 15
+    
+    genericQueryOpts := mock.AnythingOfType("*consulapi.QueryOptions")
+    genericWriteOpts := mock.AnythingOfType("*consulapi.WriteOptions")
+    
+    BeforeEach(func() {
+        var err error
+        
+        mockAgent = consulmocks.MockAgent{}
+        mockAgent.On("Self").Return(
+            map[string]map[string]interface{}{
+                "Config": map[string]interface{}{
+                    "NodeName": nodeName,
+                },
+            },
+            nil,
+        )
+        
+        receiver, err = NewLockWatcher(
+            &mockAgent,
+            &mockSession,
+            &mockKV,
+            new(consulmocks.MockHealth),
+            updateInterval,
+            lockDelay,
+            serviceName,
+            keyName,
+        )
+        
+        Expect(err).To(BeNil())
+        
+        receiver.UsePriority(5, &mockServiceHealth)
+        receiver.setSessionID(sessionID)
+        
+        mockAgent         = consulmocks.MockAgent{}
+        mockSession       = consulmocks.MockSession{}
+        mockKV            = consulmocks.MockKV{}
+        mockServiceHealth = consulmocks.MockHealth{}
+        
+        mockSession.On("Info", sessionID, genericQueryOpts).Return(
+            &consulapi.SessionEntry{ ID: sessionID, Node: nodeName },
+            new(consulapi.QueryMeta),
+            nil,
+        )
+    })
+    
+    instancePriorities := func(priorities map[string]int) {
+        var instances []*consulapi.ServiceEntry
+        for node, priority := range priorities {
+            instances = append(instances, &consulapi.ServiceEntry{
+                Node:    &consulapi.Node{ Node: node },
+                Service: &consulapi.AgentService{
+                    ID:      serviceName,
+                    Service: serviceName,
+                    Tags:    []string{ priorityTag(priority) },
+                },
+            })
+        }
+        
+        // only passing instances can take the lock
+        mockServiceHealth.On("Service", serviceName, "", true, mock.Anything).Return(
+            instances,
+            new(consulapi.QueryMeta),
+            nil,
+        )
+    }
+    
+    It("advertises its priority when registering", func() {
+        mockAgent.On(
+            "ServiceRegister",
+            mock.AnythingOfType("*consulapi.AgentServiceRegistration"),
+        ).Return(nil)
+        
+        receiver.RegisterService()
+        
+        svcReg := mockAgent.Calls[0].Arguments.Get(0).(*consulapi.AgentServiceRegistration)
+        Expect(svcReg.Tags).To(ContainElement("priority=5"))
+    })
+    
+    It("parses priority tags", func() {
+        Expect(parsePriorityTag([]string{ "foo", "priority=12" })).To(Equal(12))
+        Expect(parsePriorityTag([]string{ "priority=bar" })).To(Equal(0))
+        Expect(parsePriorityTag(nil)).To(Equal(0))
+    })
+    
+    It("defers a free lock to a higher-priority instance", func() {
+        instancePriorities(map[string]int{
+            nodeName:    5,
+            "preferred": 10,
+        })
+        
+        mockKV.On("Get", keyName, genericQueryOpts).Return(
+            &consulapi.KVPair{ Key: keyName },
+            new(consulapi.QueryMeta),
+            nil,
+        )
+        
+        locked, err := receiver.AcquireLock()
+        
+        Expect(locked).To(Equal(false))
+        Expect(err).To(BeNil())
+        
+        // never tried to acquire
+        for _, call := range mockKV.Calls {
+            Expect(call.Method).NotTo(Equal("Acquire"))
+        }
+    })
+    
+    It("acquires a free lock when it has the highest priority", func() {
+        instancePriorities(map[string]int{
+            nodeName: 5,
+            "other":  1,
+        })
+        
+        mockKV.On("Get", keyName, genericQueryOpts).Return(
+            &consulapi.KVPair{ Key: keyName },
+            new(consulapi.QueryMeta),
+            nil,
+        )
+        
+        mockKV.On(
+            "Acquire",
+            mock.AnythingOfType("*consulapi.KVPair"),
+            genericWriteOpts,
+        ).Return(true, new(consulapi.WriteMeta), nil)
+        
+        locked, err := receiver.AcquireLock()
+        
+        Expect(locked).To(Equal(true))
+        Expect(err).To(BeNil())
+    })
+    
+    It("defers to a higher-priority instance again after losing the lock", func() {
+        instancePriorities(map[string]int{
+            nodeName: 5,
+            "other":  1,
+        })
+        
+        mockKV.On("Get", keyName, genericQueryOpts).Return(
+            &consulapi.KVPair{ Key: keyName },
+            new(consulapi.QueryMeta),
+            nil,
+        )
+        
+        mockKV.On(
+            "Acquire",
+            mock.AnythingOfType("*consulapi.KVPair"),
+            genericWriteOpts,
+        ).Return(true, new(consulapi.WriteMeta), nil)
+        
+        // the lock had been free for longer than any delay
+        receiver.unlockedSince = time.Now().Add(-time.Hour)
+        
+        locked, err := receiver.AcquireLock()
+        
+        Expect(locked).To(Equal(true))
+        Expect(err).To(BeNil())
+        
+        // lost the lock while a higher-priority instance has come up
+        receiver.setHaveLock(false)
+        
+        mockKV            = consulmocks.MockKV{}
+        mockServiceHealth = consulmocks.MockHealth{}
+        
+        instancePriorities(map[string]int{
+            nodeName:    5,
+            "preferred": 10,
+        })
+        
+        mockKV.On("Get", keyName, genericQueryOpts).Return(
+            &consulapi.KVPair{ Key: keyName },
+            new(consulapi.QueryMeta),
+            nil,
+        )
+        
+        locked, err = receiver.AcquireLock()
+        
+        Expect(locked).To(Equal(false))
+        Expect(err).To(BeNil())
+        
+        for _, call := range mockKV.Calls {
+            Expect(call.Method).NotTo(Equal("Acquire"))
+        }
+    })
+    
+    It("asks a lower-priority leader to step down", func() {
+        instancePriorities(map[string]int{
+            nodeName: 5,
+            "other":  1,
+        })
+        
+        mockKV.On("Get", keyName, genericQueryOpts).Return(
+            &consulapi.KVPair{ Key: keyName, Session: "other-session" },
+            new(consulapi.QueryMeta),
+            nil,
+        )
+        
+        mockSession.On("Info", "other-session", genericQueryOpts).Return(
+            &consulapi.SessionEntry{ ID: "other-session", Node: "other" },
+            new(consulapi.QueryMeta),
+            nil,
+        )
+        
+        mockKV.On(
+            "Acquire",
+            mock.AnythingOfType("*consulapi.KVPair"),
+            genericWriteOpts,
+        ).Return(true, new(consulapi.WriteMeta), nil)
+        
+        locked, err := receiver.AcquireLock()
+        
+        Expect(locked).To(Equal(false))
+        Expect(err).To(BeNil())
+        
+        mockKV.AssertExpectations(GinkgoT())
+        
+        kvp := mockKV.Calls[1].Arguments.Get(0).(*consulapi.KVPair)
+        Expect(kvp.Key).To(Equal(stepDownKey))
+        Expect(kvp.Session).To(Equal(sessionID))
+        
+        var request stepDownRequest
+        Expect(json.Unmarshal(kvp.Value, &request)).To(BeNil())
+        Expect(request.Node).To(Equal(nodeName))
+        Expect(request.Priority).To(Equal(5))
+    })
+    
+    It("does not ask a higher-priority leader to step down", func() {
+        instancePriorities(map[string]int{
+            nodeName: 5,
+            "other":  7,
+        })
+        
+        mockKV.On("Get", keyName, genericQueryOpts).Return(
+            &consulapi.KVPair{ Key: keyName, Session: "other-session" },
+            new(consulapi.QueryMeta),
+            nil,
+        )
+        
+        mockSession.On("Info", "other-session", genericQueryOpts).Return(
+            &consulapi.SessionEntry{ ID: "other-session", Node: "other" },
+            new(consulapi.QueryMeta),
+            nil,
+        )
+        
+        locked, err := receiver.AcquireLock()
+        
+        Expect(locked).To(Equal(false))
+        Expect(err).To(BeNil())
+        
+        for _, call := range mockKV.Calls {
+            Expect(call.Method).NotTo(Equal("Acquire"))
+        }
+    })
+    
+    It("steps down when a higher-priority instance asks", func(done Done) {
+        request, _ := json.Marshal(stepDownRequest{ Node: "preferred", Priority: 10 })
+        
+        // a stale request from a dead instance is ignored
+        mockKV.On("Get", stepDownKey, genericQueryOpts).Return(
+            &consulapi.KVPair{ Key: stepDownKey, Value: request },
+            &consulapi.QueryMeta{ LastIndex: 10 },
+            nil,
+        ).Once()
+        
+        mockKV.On("Get", stepDownKey, genericQueryOpts).Return(
+            &consulapi.KVPair{ Key: stepDownKey, Session: "preferred-session", Value: request },
+            &consulapi.QueryMeta{ LastIndex: 11 },
+            nil,
+        ).Once()
+        
+        abort := make(chan interface{})
+        defer close(abort)
+        
+        c := receiver.WatchStepDown(abort)
+        
+        _, more := <-c
+        Expect(more).To(Equal(false))
+        
+        mockKV.AssertExpectations(GinkgoT())
+        
+        close(done)
+    })
+})
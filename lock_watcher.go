@@ -3,6 +3,7 @@ package main
 import (
     "time"
     "fmt"
+    "sync"
     
     log "github.com/Sirupsen/logrus"
     "github.com/armon/consul-api"
@@ -23,11 +24,41 @@ type LockWatcher struct {
     
     updateInterval time.Duration
     lockDelay      time.Duration
+    
+    // TTL of the service's health check, which we pass once per update
+    checkTTL time.Duration
 
     sessionID     string
     healthWaitIdx uint64
+    
+    // when non-zero, the session is kept alive by renewing it within this TTL
+    // instead of being tied to the service's health check
+    sessionTTL      time.Duration
+    sessionBehavior string
+    
+    // whether we believe we currently hold the lock; read by the lock auditor
+    // from a different goroutine
+    stateLock sync.RWMutex
+    haveLock  bool
+    
+    // the lock key's ModifyIndex when we acquired it.  every acquisition
+    // modifies the key, so this increases with each change of leadership and
+    // lets consumers discard events from a stale leader.
+    fencingToken uint64
+    
+    history *LeadershipHistory
+    
+    // preferred-leader priority; disabled when serviceHealth is nil.  see
+    // lock_priority.go
+    priority          int
+    serviceHealth     ConsulServiceHealth
+    unlockedSince     time.Time
+    stepDownRequested string
 }
 
+// number of leadership transitions kept in memory
+const leadershipHistoryLimit = 100
+
 func NewLockWatcher(
     agent   ConsulAgent,
     session ConsulSession,
@@ -62,18 +93,66 @@ func NewLockWatcher(
         
         updateInterval: updateInterval,
         lockDelay:      lockDelay,
+        
+        checkTTL: updateInterval * 3,
+        
+        history: NewLeadershipHistory(leadershipHistoryLimit),
     }
     
     return rcr, nil
 }
 
+// sets the TTL of the service's health check; three times the update interval
+// by default.  must be called before RegisterService.
+func (self *LockWatcher) UseCheckTTL(ttl time.Duration) error {
+    if ttl <= self.updateInterval {
+        return fmt.Errorf("check TTL must be greater than update interval")
+    }
+    
+    self.checkTTL = ttl
+    
+    return nil
+}
+
+// use a session with a TTL that is renewed periodically, rather than one tied
+// to the serfHealth and service health checks.  behavior is what Consul does
+// with the locked key when the session is invalidated: "release" or "delete".
+// must be called before InitSession.
+func (self *LockWatcher) UseSessionTTL(ttl time.Duration, behavior string) error {
+    // the session is renewed at least once per update interval
+    if ttl <= self.updateInterval {
+        return fmt.Errorf("session TTL must be greater than update interval")
+    }
+    
+    // limits enforced by Consul
+    if ttl < 10 * time.Second || ttl > time.Hour {
+        return fmt.Errorf("session TTL must be between 10s and 1h")
+    }
+    
+    if behavior != "release" && behavior != "delete" {
+        return fmt.Errorf("invalid session behavior %s", behavior)
+    }
+    
+    self.sessionTTL = ttl
+    self.sessionBehavior = behavior
+    
+    return nil
+}
+
 func (self *LockWatcher) RegisterService() error {
-    // make TTL three times the update interval
-    checkTtl := fmt.Sprintf("%ds", int((self.updateInterval * 3) / time.Second))
+    // whole seconds, rounded up so it never falls below the update interval
+    checkTtl := fmt.Sprintf("%ds", int((self.checkTTL + time.Second - 1) / time.Second))
+
+    // other instances find our priority in the service's tags
+    var tags []string
+    if self.serviceHealth != nil {
+        tags = []string{ priorityTag(self.priority) }
+    }
 
     return self.agent.ServiceRegister(&consulapi.AgentServiceRegistration{
         ID:    self.serviceName,
         Name:  self.serviceName,
+        Tags:  tags,
         Check: &consulapi.AgentServiceCheck{
             TTL: checkTtl,
         },
@@ -83,7 +162,7 @@ func (self *LockWatcher) RegisterService() error {
 func (self *LockWatcher) InitSession() (string, error) {
     log.Debug("initializing session")
     
-    self.sessionID = ""
+    self.setSessionID("")
     
     sess := self.session
 
@@ -93,66 +172,205 @@ func (self *LockWatcher) InitSession() (string, error) {
     }
     
     for _, sessionEntry := range sessions {
+        // don't pick up a session of the wrong type left behind by a previous
+        // instance running with different options
+        if (sessionEntry.TTL != "") != (self.sessionTTL > 0) {
+            continue
+        }
+        
         if (sessionEntry.Node == self.nodeName) && (sessionEntry.Name == self.serviceName) {
-            self.sessionID = sessionEntry.ID
+            self.setSessionID(sessionEntry.ID)
             
             log.WithFields(log.Fields{
-                "session": self.sessionID,
+                "session": sessionEntry.ID,
             }).Debug("found existing session")
             
             break
         }
     }
     
-    if self.sessionID == "" {
+    if self.SessionID() == "" {
         log.Info("creating session")
         
-        // Unexpected response code: 500 (Check 'service:riemann-consul-receiver' is in critical state)
-        // so we'll tickle the health check first
-        self.UpdateHealthCheck()
-                
-        sessionID, _, err := sess.Create(
-            &consulapi.SessionEntry{
-                Name: self.serviceName,
-                LockDelay: self.lockDelay,
-                Checks: []string{
-                    "serfHealth",
-                    "service:" + self.serviceName,
-                },
-            },
-            nil,
-        )
+        sessionEntry := &consulapi.SessionEntry{
+            Name: self.serviceName,
+            LockDelay: self.lockDelay,
+        }
+        
+        if self.sessionTTL > 0 {
+            // only tied to the node's health; we keep it alive by renewing
+            sessionEntry.Checks = []string{"serfHealth"}
+            sessionEntry.TTL = fmt.Sprintf("%ds", int(self.sessionTTL / time.Second))
+            sessionEntry.Behavior = self.sessionBehavior
+        } else {
+            // Unexpected response code: 500 (Check 'service:riemann-consul-receiver' is in critical state)
+            // so we'll tickle the health check first
+            self.UpdateHealthCheck()
+            
+            sessionEntry.Checks = []string{
+                "serfHealth",
+                "service:" + self.serviceName,
+            }
+        }
+        
+        sessionID, _, err := sess.Create(sessionEntry, nil)
         
         if err != nil {
             return "", fmt.Errorf("unable to create session: %v", err)
         }
         
-        self.sessionID = sessionID
+        self.setSessionID(sessionID)
     }
     
+    sessionID := self.SessionID()
+    
     log.WithFields(log.Fields{
-        "session": self.sessionID,
+        "session": sessionID,
     }).Info("have session")
     
-    return self.sessionID, nil
+    return sessionID, nil
+}
+
+func (self *LockWatcher) SessionID() string {
+    self.stateLock.RLock()
+    defer self.stateLock.RUnlock()
+    
+    return self.sessionID
+}
+
+func (self *LockWatcher) setSessionID(sessionID string) {
+    self.stateLock.Lock()
+    defer self.stateLock.Unlock()
+    
+    self.sessionID = sessionID
+}
+
+func (self *LockWatcher) ServiceName() string {
+    return self.serviceName
+}
+
+func (self *LockWatcher) KeyPath() string {
+    return self.keyPath
+}
+
+// returns true if we believe we currently hold the lock
+func (self *LockWatcher) HaveLock() bool {
+    self.stateLock.RLock()
+    defer self.stateLock.RUnlock()
+    
+    return self.haveLock
+}
+
+func (self *LockWatcher) setHaveLock(haveLock bool) {
+    self.stateLock.Lock()
+    defer self.stateLock.Unlock()
+    
+    self.haveLock = haveLock
+    
+    if haveLock {
+        metricLeader.Set(1)
+    } else {
+        metricLeader.Set(0)
+        self.fencingToken = 0
+    }
+}
+
+// the fencing token for the current leadership term; 0 if we don't hold the
+// lock
+func (self *LockWatcher) FencingToken() uint64 {
+    self.stateLock.RLock()
+    defer self.stateLock.RUnlock()
+    
+    return self.fencingToken
+}
+
+func (self *LockWatcher) setFencingToken(token uint64) {
+    self.stateLock.Lock()
+    defer self.stateLock.Unlock()
+    
+    self.fencingToken = token
+}
+
+func (self *LockWatcher) History() *LeadershipHistory {
+    return self.history
+}
+
+func (self *LockWatcher) recordTransition(transitionType, reason string) {
+    log.WithFields(log.Fields{
+        "transition": transitionType,
+        "session":    self.SessionID(),
+    }).Info(reason)
+    
+    switch transitionType {
+        case TransitionAcquired:
+            metricLockAcquisitions.Inc()
+        
+        case TransitionLost, TransitionReleased:
+            metricLockLosses.Inc(transitionType)
+    }
+    
+    self.history.Record(LeadershipTransition{
+        Type:         transitionType,
+        Reason:       reason,
+        Session:      self.SessionID(),
+        FencingToken: self.FencingToken(),
+    })
 }
 
 func (self *LockWatcher) DestroySession() {
+    sessionID := self.SessionID()
+    
     log.WithFields(log.Fields{
-        "session": self.sessionID,
+        "session": sessionID,
     }).Info("destroying session")
     
-    self.session.Destroy(self.sessionID, nil)
+    self.session.Destroy(sessionID, nil)
 }
 
 func (self *LockWatcher) UpdateHealthCheck() error {
     return self.agent.PassTTL("service:" + self.serviceName, "")
 }
 
+// renews the session if it has a TTL; a no-op otherwise.  if the session has
+// already expired a new one is created, but any lock held by the old one has
+// been lost.
+func (self *LockWatcher) RenewSession() error {
+    if self.sessionTTL == 0 {
+        return nil
+    }
+    
+    sessionEntry, _, err := self.session.Renew(self.SessionID(), nil)
+    
+    if err != nil {
+        return fmt.Errorf("unable to renew session: %v", err)
+    }
+    
+    if sessionEntry == nil {
+        expiredSessionID := self.SessionID()
+        
+        log.WithFields(log.Fields{
+            "session": expiredSessionID,
+        }).Warn("session expired; creating a new one")
+        
+        self.setHaveLock(false)
+        
+        _, err = self.InitSession()
+        
+        if err == nil {
+            self.recordTransition(TransitionSessionRecreated, fmt.Sprintf("session %s expired", expiredSessionID))
+        }
+    }
+    
+    return err
+}
+
 // attempt to acquire lock.  returns true if lock acquired, false otherwise.
 func (self *LockWatcher) AcquireLock() (bool, error) {
+    // the session can be replaced by RenewSession, so use the same one throughout
+    sessionID := self.SessionID()
+    
     // verify session's still valid
-    sessionEntry, _, err := self.session.Info(self.sessionID, nil)
+    sessionEntry, _, err := self.session.Info(sessionID, nil)
     
     if err != nil {
         // can just log and return false here; an error is is probably the
@@ -164,13 +382,16 @@ func (self *LockWatcher) AcquireLock() (bool, error) {
 
     if sessionEntry == nil {
         // this is an actual error!
-        return false, fmt.Errorf("session %s is no longer valid", self.sessionID)
+        return false, fmt.Errorf("session %s is no longer valid", sessionID)
     }
     
+    start := time.Now()
     kvp, queryMeta, err := self.kv.Get(self.keyPath, &consulapi.QueryOptions{
         WaitIndex: self.keyModifyIdx,
         WaitTime: self.lockDelay,
     })
+    observeConsulCall("lock_get", start, queryMeta, err)
+    observeBlockingQuery("lock_get", self.keyModifyIdx, queryMeta)
     
     if err != nil {
         // can just log and return false here; an error is is probably the
@@ -181,14 +402,32 @@ func (self *LockWatcher) AcquireLock() (bool, error) {
     }
     
     isLocked := (kvp != nil) && (kvp.Session != "")
-    lockedByUs := isLocked && (kvp.Session == self.sessionID)
+    lockedByUs := isLocked && (kvp.Session == sessionID)
     self.keyModifyIdx = queryMeta.LastIndex
+    
+    fencingToken := uint64(0)
+    reason := "acquired lock"
+    if lockedByUs {
+        // probably a session left over from a previous run
+        fencingToken = kvp.ModifyIndex
+        reason = "lock already held by our session"
+    }
 
-    if ! isLocked {
+    if isLocked {
+        self.unlockedSince = time.Time{}
+        
+        if ! lockedByUs {
+            self.requestStepDown(kvp.Session)
+        }
+    }
+    
+    if ! isLocked && ! self.deferToHigherPriority() {
+        start := time.Now()
         lockedByUs, _, err = self.kv.Acquire(&consulapi.KVPair{
             Key: self.keyPath,
-            Session: self.sessionID,
+            Session: sessionID,
         }, nil)
+        observeConsulCall("lock_acquire", start, nil, err)
         
         if err != nil {
             // can just log and return false here; an error is is probably the
@@ -197,45 +436,110 @@ func (self *LockWatcher) AcquireLock() (bool, error) {
             log.Errorf("unable to acquire lock: %v", err)
             return false, nil
         }
+        
+        if lockedByUs {
+            // the priority delay starts over the next time the lock is free
+            self.unlockedSince = time.Time{}
+            
+            fencingToken = self.readFencingToken(sessionID)
+        }
+    }
+    
+    hadLock := self.HaveLock()
+    
+    self.setHaveLock(lockedByUs)
+    self.setFencingToken(fencingToken)
+    
+    if lockedByUs && ! hadLock {
+        self.recordTransition(TransitionAcquired, reason)
+        self.withdrawStepDownRequest()
     }
     
     return lockedByUs, err
 }
 
+// reads the key's ModifyIndex after sessionID acquired the lock.  returns 0 if
+// the key can't be read, which consumers will treat as stale.
+func (self *LockWatcher) readFencingToken(sessionID string) uint64 {
+    start := time.Now()
+    kvp, queryMeta, err := self.kv.Get(self.keyPath, nil)
+    observeConsulCall("lock_get", start, queryMeta, err)
+    
+    if err != nil {
+        log.Errorf("unable to retrieve key %s for fencing token: %v", self.keyPath, err)
+        return 0
+    }
+    
+    if kvp == nil || kvp.Session != sessionID {
+        log.Errorf("lock on %s lost before fencing token could be read", self.keyPath)
+        return 0
+    }
+    
+    return kvp.ModifyIndex
+}
+
 func (self *LockWatcher) WatchLock() <-chan interface{} {
     watchChan := make(chan interface{})
     lockedByUs := true
+    sessionID := self.SessionID()
     
     go func() {
+        reason := ""
+        
         for lockedByUs {
+            start := time.Now()
             kvp, queryMeta, err := self.kv.Get(self.keyPath, &consulapi.QueryOptions{
                 WaitIndex: self.keyModifyIdx,
                 WaitTime: time.Minute,
             })
+            observeConsulCall("lock_watch", start, queryMeta, err)
+            observeBlockingQuery("lock_watch", self.keyModifyIdx, queryMeta)
             
             if err == nil {
                 isLocked := (kvp != nil) && (kvp.Session != "")
-                lockedByUs = isLocked && (kvp.Session == self.sessionID)
+                lockedByUs = isLocked && (kvp.Session == sessionID)
                 self.keyModifyIdx = queryMeta.LastIndex
+                
+                if ! isLocked {
+                    reason = "lock is no longer held"
+                } else if ! lockedByUs {
+                    reason = fmt.Sprintf("lock is now held by session %s", kvp.Session)
+                }
             } else {
                 log.Errorf("unable to check key: %v", err)
             }
         }
         
+        // the lock may have been released voluntarily in the meantime, which
+        // has already been recorded
+        if self.HaveLock() {
+            self.recordTransition(TransitionLost, reason)
+        }
+        
+        self.setHaveLock(false)
         close(watchChan)
     }()
     
     return watchChan
 }
 
-func (self *LockWatcher) ReleaseLock() error {
+// voluntarily release the lock; reason is recorded in the leadership history
+func (self *LockWatcher) ReleaseLock(reason string) error {
+    if self.HaveLock() {
+        self.recordTransition(TransitionReleased, reason)
+    }
+    
+    self.setHaveLock(false)
+    
+    start := time.Now()
     _, _, err := self.kv.Release(
         &consulapi.KVPair{
             Key: self.keyPath,
-            Session: self.sessionID,
+            Session: self.SessionID(),
         },
         nil,
     )
+    observeConsulCall("lock_release", start, nil, err)
     
     return err
 }
@@ -91,6 +91,21 @@ var _ = Describe("LockWatcher", func() {
     
     It("registers the service", registersService)
     
+    It("registers the service with a custom check TTL", func() {
+        Expect(receiver.UseCheckTTL(time.Second)).NotTo(BeNil())
+        Expect(receiver.UseCheckTTL(150500 * time.Millisecond)).To(BeNil())
+        
+        mockAgent.On(
+            "ServiceRegister",
+            mock.AnythingOfType("*consulapi.AgentServiceRegistration"),
+        ).Return(nil)
+        
+        receiver.RegisterService()
+        
+        svcReg := mockAgent.Calls[0].Arguments.Get(0).(*consulapi.AgentServiceRegistration)
+        Expect(svcReg.Check.TTL).To(Equal("151s"))
+    })
+    
     passesHealthCheck := func() {
         mockAgent.On("PassTTL", "service:" + serviceName, "").Return(nil)
         
@@ -185,6 +200,102 @@ var _ = Describe("LockWatcher", func() {
         Expect(err).To(BeNil())
     })
 
+    Describe("session TTL mode", func() {
+        BeforeEach(func() {
+            Expect(receiver.UseSessionTTL(time.Minute * 5, "delete")).To(BeNil())
+        })
+        
+        It("rejects a TTL shorter than the update interval", func() {
+            Expect(receiver.UseSessionTTL(time.Minute, "release")).NotTo(BeNil())
+        })
+        
+        It("rejects an unknown behavior", func() {
+            Expect(receiver.UseSessionTTL(time.Minute * 5, "explode")).NotTo(BeNil())
+        })
+        
+        It("creates a session with a TTL and no service check", func() {
+            var nilQueryMeta *consulapi.QueryMeta = nil
+            
+            // an existing check-based session must not be reused
+            mockSession.On(
+                "List",
+                mock.AnythingOfType("*consulapi.QueryOptions"),
+            ).Return(
+                []*consulapi.SessionEntry{
+                    &consulapi.SessionEntry{
+                        Node: nodeName,
+                        Name: serviceName,
+                        ID:   "old-session",
+                    },
+                },
+                nilQueryMeta,
+                nil,
+            )
+            
+            mockSession.On(
+                "Create",
+                mock.AnythingOfType("*consulapi.SessionEntry"),
+                mock.AnythingOfType("*consulapi.WriteOptions"),
+            ).Return(sessionID, &consulapi.WriteMeta{}, nil)
+            
+            newSessionId, err := receiver.InitSession()
+            
+            // health check isn't tickled
+            mockAgent.AssertExpectations(GinkgoT())
+            
+            Expect(newSessionId).To(Equal(sessionID))
+            Expect(err).To(BeNil())
+            
+            sess := mockSession.Calls[1].Arguments.Get(0).(*consulapi.SessionEntry)
+            Expect(sess.TTL).To(Equal("300s"))
+            Expect(sess.Behavior).To(Equal("delete"))
+            Expect(sess.Checks).To(Equal([]string{"serfHealth"}))
+        })
+        
+        It("renews the session", func() {
+            receiver.setSessionID(sessionID)
+            
+            mockSession.On(
+                "Renew",
+                sessionID,
+                mock.AnythingOfType("*consulapi.WriteOptions"),
+            ).Return(&consulapi.SessionEntry{ ID: sessionID }, new(consulapi.WriteMeta), nil)
+            
+            Expect(receiver.RenewSession()).To(BeNil())
+            Expect(receiver.SessionID()).To(Equal(sessionID))
+            
+            mockSession.AssertExpectations(GinkgoT())
+        })
+        
+        It("recreates the session when it has expired", func() {
+            var nilQueryMeta *consulapi.QueryMeta = nil
+            
+            receiver.setSessionID("expired-session")
+            
+            mockSession.On(
+                "Renew",
+                "expired-session",
+                mock.AnythingOfType("*consulapi.WriteOptions"),
+            ).Return(nil, new(consulapi.WriteMeta), nil)
+            
+            mockSession.On(
+                "List",
+                mock.AnythingOfType("*consulapi.QueryOptions"),
+            ).Return([]*consulapi.SessionEntry{}, nilQueryMeta, nil)
+            
+            mockSession.On(
+                "Create",
+                mock.AnythingOfType("*consulapi.SessionEntry"),
+                mock.AnythingOfType("*consulapi.WriteOptions"),
+            ).Return(sessionID, &consulapi.WriteMeta{}, nil)
+            
+            Expect(receiver.RenewSession()).To(BeNil())
+            Expect(receiver.SessionID()).To(Equal(sessionID))
+            
+            mockSession.AssertExpectations(GinkgoT())
+        })
+    })
+
     Describe("lock acquisition", func() {
         validSession := &consulapi.SessionEntry{}
         genericQueryOpts := mock.AnythingOfType("*consulapi.QueryOptions")
@@ -236,6 +347,30 @@ var _ = Describe("LockWatcher", func() {
             Expect(err).To(BeNil())
         })
         
+        It("uses the ModifyIndex of a lock already held by us as the fencing token", func() {
+            mockSession.On("Info", sessionID, genericQueryOpts).Return(
+                validSession,
+                new(consulapi.QueryMeta),
+                nil,
+            )
+
+            mockKV.On("Get", keyName, genericQueryOpts).Return(
+                &consulapi.KVPair{
+                    Key: keyName,
+                    Session: sessionID,
+                    ModifyIndex: 7,
+                },
+                new(consulapi.QueryMeta),
+                nil,
+            )
+            
+            success, err := receiver.AcquireLock()
+            
+            Expect(success).To(Equal(true))
+            Expect(err).To(BeNil())
+            Expect(receiver.FencingToken()).To(Equal(uint64(7)))
+        })
+        
         It("is locked by someone else", func() {
             mockSession.On("Info", sessionID, genericQueryOpts).Return(
                 validSession,
@@ -300,6 +435,69 @@ var _ = Describe("LockWatcher", func() {
             Expect(err).To(BeNil())
         })
 
+        It("uses the key's ModifyIndex as the fencing token", func() {
+            mockSession.On("Info", sessionID, genericQueryOpts).Return(
+                validSession,
+                new(consulapi.QueryMeta),
+                nil,
+            )
+
+            // before acquiring
+            mockKV.On("Get", keyName, genericQueryOpts).Return(
+                &consulapi.KVPair{
+                    Key: keyName,
+                    Session: "",
+                    ModifyIndex: 10,
+                },
+                new(consulapi.QueryMeta),
+                nil,
+            ).Once()
+            
+            mockKV.On(
+                "Acquire",
+                mock.AnythingOfType("*consulapi.KVPair"),
+                mock.AnythingOfType("*consulapi.WriteOptions"),
+            ).Return(true, new(consulapi.WriteMeta), nil)
+            
+            // after acquiring
+            mockKV.On("Get", keyName, genericQueryOpts).Return(
+                &consulapi.KVPair{
+                    Key: keyName,
+                    Session: sessionID,
+                    ModifyIndex: 12,
+                },
+                new(consulapi.QueryMeta),
+                nil,
+            ).Once()
+            
+            success, err := receiver.AcquireLock()
+            
+            mockSession.AssertExpectations(GinkgoT())
+            mockKV.AssertExpectations(GinkgoT())
+            
+            Expect(success).To(Equal(true))
+            Expect(err).To(BeNil())
+            Expect(receiver.FencingToken()).To(Equal(uint64(12)))
+            
+            // released when the lock is
+            mockKV.On(
+                "Release",
+                mock.AnythingOfType("*consulapi.KVPair"),
+                mock.AnythingOfType("*consulapi.WriteOptions"),
+            ).Return(true, new(consulapi.WriteMeta), nil)
+            
+            receiver.ReleaseLock("done testing")
+            Expect(receiver.FencingToken()).To(Equal(uint64(0)))
+            
+            // both transitions are recorded
+            transitions := receiver.History().Transitions()
+            Expect(transitions).To(HaveLen(2))
+            Expect(transitions[0].Type).To(Equal(TransitionAcquired))
+            Expect(transitions[0].FencingToken).To(Equal(uint64(12)))
+            Expect(transitions[1].Type).To(Equal(TransitionReleased))
+            Expect(transitions[1].Reason).To(Equal("done testing"))
+        })
+
         It("is not able to be successfully locked", func() {
             mockSession.On("Info", sessionID, genericQueryOpts).Return(
                 validSession,
@@ -573,5 +771,27 @@ var _ = Describe("LockWatcher", func() {
             // test's done *bing!*
             close(done)
         })
+        
+        It("no longer has the lock once it's gone", func(done Done) {
+            genericQueryOpts := mock.AnythingOfType("*consulapi.QueryOptions")
+            
+            receiver.setHaveLock(true)
+            
+            mockKV.On("Get", keyName, genericQueryOpts).Return(
+                &consulapi.KVPair{
+                    Key: keyName,
+                    Session: "other-session",
+                },
+                new(consulapi.QueryMeta),
+                nil,
+            )
+            
+            _, more := <-receiver.WatchLock()
+            Expect(more).To(Equal(false))
+            
+            Expect(receiver.HaveLock()).To(Equal(false))
+            
+            close(done)
+        })
     })
 })
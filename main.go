@@ -6,7 +6,9 @@ import (
     "syscall"
     "fmt"
     "time"
+    "strconv"
     "net/http"
+    "io/ioutil"
     
     log "github.com/Sirupsen/logrus"
     flags "github.com/jessevdk/go-flags"
@@ -19,80 +21,61 @@ import (
 var version string = "undef"
 
 type Options struct {
-    Debug          bool   `env:"DEBUG"           long:"debug"                                            description:"enable debug logging"`
-    LogFile        string `env:"LOG_FILE"        long:"log-file"                                         description:"JSON log file path"`
-    RiemannHost    string `env:"RIEMANN_HOST"    long:"riemann-host" required:"true"                     description:"Riemann host"`
-    RiemannPort    int    `env:"RIEMANN_PORT"    long:"riemann-port"                 default:"5555"      description:"Riemann port"`
-    Proto          string `env:"RIEMANN_PROTO"   long:"proto"                        default:"udp"       description:"protocol to use when sending Riemann events"`
-    ConsulHost     string `env:"CONSUL_HOST"     long:"consul-host"                  default:"127.0.0.1" description:"Consul host"`
-    ConsulPort     int    `env:"CONSUL_PORT"     long:"consul-port"                  default:"8500"      description:"Consul port"`
-    UpdateInterval string `env:"UPDATE_INTERVAL" long:"interval"                     default:"1m"        description:"how frequently to post events to Riemann"`
-    LockDelay      string `env:"LOCK_DELAY"      long:"lock-delay"                   default:"15s"       description:"lock delay after session invalidation"`
-    PrintVersion   bool   `                      long:"version"                                          description:"display version and exit"`
-}
-
-func sendHealthResults(riemann RiemannClient, healthResults []HealthCheck, updateInterval time.Duration, nodeName, dc string) error {
-    for _, healthCheck := range healthResults {
-        // {
-        //   "Name": "Service 'client-youngaustria' check",
-        //   "ServiceName": "client-youngaustria",
-        //   "Node": "web-fwork-gen-028.us-east-1.aws.prod.bsdinternal.com"
-        //   "CheckID": "service:client-youngaustria",
-        //   "ServiceID": "client-youngaustria",
-        //   "Output": "TTL expired",
-        //   "Notes": "",
-        //   "Status": "critical",
-        // },
-
-        // Riemann event TTL: A floating-point time, in seconds, that
-        // this event is considered valid for
-        eventTtl := float32((updateInterval * 3) / time.Second)
-        
-        // convert Consul status to Riemann state
-        state := map[string]string{
-            "passing":  "ok",
-            "warning":  "warning",
-            "critical": "critical",
-        }[healthCheck.Status]
-        
-        // there may be multiple services with the same name on a given host;
-        // these must have different serviceIds. there are also checks that
-        // aren't associated with a specific service.  service-specific checks
-        // have an id of "service:<serviceId>".
-        evt := &raidman.Event{
-            Ttl:         eventTtl,
-            Time:        time.Now().Unix(),
-            Tags:        append(healthCheck.Tags, "consul"),
-            Host:        healthCheck.Node,
-            State:       state,
-            Service:     healthCheck.CheckID,
-            Description: healthCheck.Output,
-            Attributes:  map[string]string{
-                "reporting_node": nodeName,
-                "datacenter":     dc,
-                "notes":          healthCheck.Notes,
-            },
-        }
-        
-        err := riemann.Send(evt)
-        
-        if err != nil {
-            return err
-        }
-    }
-    
-    return nil
+    Debug                 bool     `env:"DEBUG"                           long:"debug"                                                                          description:"enable debug logging"`
+    LogFile               string   `env:"LOG_FILE"                        long:"log-file"                                                                       description:"JSON log file path"`
+    RiemannHost           string   `env:"RIEMANN_HOST"                    long:"riemann-host"                                                                   description:"Riemann host; required for the riemann sink and events about the receiver itself"`
+    RiemannPort           int      `env:"RIEMANN_PORT"                    long:"riemann-port"                    default:"5555"                                 description:"Riemann port"`
+    Proto                 string   `env:"RIEMANN_PROTO"                   long:"proto"                           default:"udp"                                  description:"protocol for Riemann events: udp (with tcp for events too large for a datagram), tcp, or auto (tcp if available, otherwise udp)"`
+    Reliable              bool     `env:"RIEMANN_RELIABLE"                long:"reliable"                                                                       description:"send every Riemann event via TCP and require Riemann to acknowledge it, regardless of --proto"`
+    UDPMaxSize            int      `env:"UDP_MAX_SIZE"                    long:"udp-max-size"                    default:"16384"                                description:"largest event, in bytes, sent to Riemann over UDP; larger ones are sent over TCP"`
+    ConsulHost            string   `env:"CONSUL_HOST"                     long:"consul-host"                     default:"127.0.0.1"                            description:"Consul host"`
+    ConsulPort            int      `env:"CONSUL_PORT"                     long:"consul-port"                     default:"8500"                                 description:"Consul port"`
+    UpdateInterval        string   `env:"UPDATE_INTERVAL"                 long:"interval"                        default:"1m"                                   description:"how frequently to post events to Riemann"`
+    EventTTL              string   `env:"EVENT_TTL"                       long:"event-ttl"                       default:"3x"                                   description:"TTL of Riemann events, as a multiple of the update interval (e.g. 3x) or a duration (e.g. 5m); services may override it with a riemann-ttl=<seconds> tag"`
+    CheckTTL              string   `env:"CHECK_TTL"                       long:"check-ttl"                       default:"3x"                                   description:"TTL of the receiver's own service health check, as a multiple of the update interval or a duration"`
+    LockDelay             string   `env:"LOCK_DELAY"                      long:"lock-delay"                      default:"15s"                                  description:"lock delay after session invalidation"`
+    Priority              int      `env:"PRIORITY"                        long:"priority"                        default:"0"                                    description:"leadership preference; the available instance with the highest priority holds the lock; disabled if 0, so set it on every instance"`
+    SessionMode           string   `env:"SESSION_MODE"                    long:"session-mode"                    default:"check"                                description:"how the session is kept alive: check (tied to the service health check) or ttl (renewed periodically; the service is then only registered if --priority is set)"`
+    SessionTTL            string   `env:"SESSION_TTL"                     long:"session-ttl"                                                                    description:"session TTL in ttl mode; defaults to 3 times the update interval"`
+    SessionBehavior       string   `env:"SESSION_BEHAVIOR"                long:"session-behavior"                default:"release"                              description:"what happens to the lock when a ttl session expires: release or delete"`
+    AuditInterval         string   `env:"AUDIT_INTERVAL"                  long:"audit-interval"                  default:"1m"                                   description:"how frequently to check the lock for anomalies; 0 to disable"`
+    Sinks                 []string `env:"SINKS"                           long:"sink"                            default:"riemann"                              env-delim:"," description:"where to send health results: riemann, file:<path>, webhook:<url>, transitions:<url>, statsd:<host:port>, graphite:<host:port> or prometheus; may be repeated"`
+    ServiceRollupFormat   string   `env:"SERVICE_ROLLUP_FORMAT"           long:"service-rollup-format"                                                          description:"send per-service health rollups to Riemann under this service name, with %s replaced by the Consul service name, e.g. consul service %s; disabled if empty"`
+    NodeRollupName        string   `env:"NODE_ROLLUP_NAME"                long:"node-rollup-name"                                                               description:"send per-node health rollups to Riemann under this service name, e.g. consul node; disabled if empty"`
+    NodeDownMode          string   `env:"NODE_DOWN_MODE"                  long:"node-down-mode"                  default:"send"                                 description:"what to do with a node's other checks when its serfHealth check is critical: send, tag (as suppressed) or collapse (into the serfHealth event)"`
+    MaintenanceState      string   `env:"MAINTENANCE_STATE"               long:"maintenance-state"               default:"maintenance"                          description:"Riemann state for checks of nodes and services in maintenance mode; sent as critical if empty"`
+    FlapWindow            string   `env:"FLAP_WINDOW"                     long:"flap-window"                     default:"0"                                    description:"window for flap detection, e.g. 10m; disabled if 0"`
+    FlapThreshold         int      `env:"FLAP_THRESHOLD"                  long:"flap-threshold"                  default:"5"                                    description:"number of status changes within the flap window for a check to be flapping"`
+    ExpiredState          string   `env:"EXPIRED_STATE"                   long:"expired-state"                                                                  description:"Riemann state of the final event sent for a check that disappears from Consul, e.g. expired or ok; none is sent if empty"`
+    CheckStatePrefix      string   `env:"CHECK_STATE_PREFIX"              long:"check-state-prefix"              default:"riemann-consul-receiver/check-states" description:"KV prefix under which each node's check states are kept for the next leader"`
+    MetadataPrefix        string   `env:"METADATA_PREFIX"                 long:"metadata-prefix"                                                                description:"KV prefix of per-service event attributes, read from <prefix>/<service>/meta (a JSON object) and <prefix>/<service>/meta/<attribute>; disabled if empty"`
+    NodeMetaAttributes    []string `env:"NODE_META_ATTRIBUTES"            long:"node-meta-attribute"                                                            env-delim:"," description:"node metadata key to add to events as a node_meta.<key> attribute; may be repeated"`
+    NodeMetaTags          []string `env:"NODE_META_TAGS"                  long:"node-meta-tag"                                                                  env-delim:"," description:"node metadata key to add to events as a <key>:<value> tag; may be repeated"`
+    OutputMaxBytes        int      `env:"OUTPUT_MAX_BYTES"                long:"output-max-bytes"                default:"4096"                                 description:"truncate check output sent to Riemann to this many bytes; unlimited if 0"`
+    OutputMaxLines        int      `env:"OUTPUT_MAX_LINES"                long:"output-max-lines"                default:"0"                                    description:"truncate check output sent to Riemann to this many lines; unlimited if 0"`
+    OutputRedact          []string `env:"OUTPUT_REDACT"                   long:"output-redact"                                                                  env-delim:";" description:"regular expression for secrets to redact from check output; may be repeated"`
+    MetricPrefix          string   `env:"METRIC_PREFIX"                   long:"metric-prefix"                   default:"consul"                               description:"prefix for StatsD and Graphite metric names"`
+    TransitionHeaders     []string `env:"TRANSITION_WEBHOOK_HEADERS"      long:"transition-webhook-header"                                                      env-delim:"," description:"header for transition webhook requests, as Name: value; may be repeated"`
+    TransitionTemplate    string   `env:"TRANSITION_WEBHOOK_TEMPLATE"     long:"transition-webhook-template"                                                    description:"Go template file for the transition webhook request body; JSON if empty"`
+    TransitionRetries     int      `env:"TRANSITION_WEBHOOK_RETRIES"      long:"transition-webhook-retries"      default:"3"                                    description:"how many times to retry a failed transition webhook request"`
+    TransitionTimeout     string   `env:"TRANSITION_WEBHOOK_TIMEOUT"      long:"transition-webhook-timeout"      default:"5s"                                   description:"timeout of each transition webhook request"`
+    TransitionRetryBudget string   `env:"TRANSITION_WEBHOOK_RETRY_BUDGET" long:"transition-webhook-retry-budget" default:"30s"                                  description:"how long to keep retrying a transition webhook request before trying again with the next update"`
+    TransitionQueueSize   int      `env:"TRANSITION_WEBHOOK_QUEUE_SIZE"   long:"transition-webhook-queue-size"   default:"100"                                  description:"transition webhook requests that may be waiting to be made"`
+    TransitionSecret      string   `env:"TRANSITION_WEBHOOK_SECRET"       long:"transition-webhook-secret"                                                      description:"if set, transition webhook requests are signed with HMAC-SHA256 in the X-Signature header"`
+    TransitionBatch       bool     `env:"TRANSITION_WEBHOOK_BATCH"        long:"transition-webhook-batch"                                                       description:"send all transitions found in an update in a single request"`
+    ExportCheckStates     bool     `env:"EXPORT_CHECK_STATES"             long:"export-check-states"                                                            description:"also expose the check states on the Prometheus metrics endpoint"`
+    DryRun                bool     `env:"DRY_RUN"                         long:"dry-run"                                                                        description:"print the events Riemann would get to stdout as JSON instead of sending them; other sinks are not used and nothing is saved to Consul, but unless --skip-lock is given the service is registered and takes part in the lock election"`
+    SkipLock              bool     `env:"SKIP_LOCK"                       long:"skip-lock"                                                                      description:"with --dry-run, don't register the service or acquire the lock; just watch the health results"`
+    HttpAddr              string   `env:"HTTP_ADDR"                       long:"http-addr"                                                                      description:"address for the status and metrics HTTP endpoints, e.g. :8080; disabled if empty"`
+    PrintVersion          bool     `                                      long:"version"                                                                        description:"display version and exit"`
 }
 
 func mainLoop(
     lockWatcher    *LockWatcher,
     healthChecker  *HealthChecker,
-    riemannHost    string,
-    riemannPort    int,
-    riemannProto   string,
+    sinks          *SinkSet,
     updateInterval time.Duration,
-    nodeName       string,
-    dc             string,
+    registered     bool,
     done           chan<- interface{},
 ) {
     // indicate to caller when this routine is done; just close channel so the
@@ -105,23 +88,40 @@ func mainLoop(
     // used to notify when lock has been lost; it'll just get closed
     var lockWatchChan <-chan interface{}
     
+    // closed when a higher-priority instance wants the lock, and the control
+    // channel for the routine watching for that request
+    var stepDownChan <-chan interface{}
+    var stepDownAbort chan interface{}
+    
     // receives HealthCheck results
     var healthResultsChan <-chan []HealthCheck
     
     // control channel for the health results checker
     var healthResultsAbort chan interface{}
 
-    // the riemann client
-    var riemann RiemannClient
-
     keepGoing := true
     haveLock := false
     
     for keepGoing {
         // @todo update health check only when don't have lock or when health
         // results are processed successfully.
-        err := lockWatcher.UpdateHealthCheck()
-        checkError("unable to submit health check", err)
+        var err error
+        
+        // best effort; in check mode the session goes with a failing check,
+        // and AcquireLock or the lock watch notices that
+        if registered {
+            err = lockWatcher.UpdateHealthCheck()
+            if err != nil {
+                log.Warnf("unable to submit health check: %v", err)
+            }
+        }
+        
+        err = lockWatcher.RenewSession()
+        if err != nil {
+            // probably the cluster not having a leader; AcquireLock will fail
+            // if the session's really gone
+            log.Error(err)
+        }
 
         if ! haveLock {
             log.Debug("acquiring lock")
@@ -133,22 +133,24 @@ func mainLoop(
             if haveLock {
                 log.Info("acquired lock")
                 
-                // connect to Riemann
-                riemannAddr := fmt.Sprintf("%s:%d", riemannHost, riemannPort)
-                log.Infof("connecting to Riemann at %s via %s", riemannAddr, riemannProto)
-
-                riemann, err = raidman.Dial(riemannProto, riemannAddr)
+                // connect to Riemann, etc.
+                err = sinks.Open()
                 
                 if err != nil {
-                    log.Errorf("unable to connect to Riemann: %v", err)
-                    lockWatcher.ReleaseLock()
+                    log.Errorf("unable to open sinks: %v", err)
+                    sinks.Close()
+                    lockWatcher.ReleaseLock(fmt.Sprintf("unable to open sinks: %v", err))
                     haveLock = false
                 } else {
-                    log.Info("connected")
+                    log.Info("sinks opened")
 
                     // get notified when we lose our lock
                     lockWatchChan = lockWatcher.WatchLock()
                     
+                    // and when we should give it up
+                    stepDownAbort = make(chan interface{})
+                    stepDownChan = lockWatcher.WatchStepDown(stepDownAbort)
+                    
                     // start retrieving health results
                     healthResultsAbort = make(chan interface{})
                     healthResultsChan = healthChecker.WatchHealthResults(healthResultsAbort)
@@ -181,8 +183,20 @@ func mainLoop(
                     
                     lockWatchChan = nil
                     
-                    riemann.Close()
-                    riemann = nil
+                    if stepDownAbort != nil {
+                        close(stepDownAbort)
+                        stepDownAbort = nil
+                    }
+                    
+                    stepDownChan = nil
+                    
+                    sinks.Close()
+                
+                case <-stepDownChan:
+                    // releasing the lock causes lockWatchChan to be closed,
+                    // which cleans up everything else
+                    stepDownChan = nil
+                    lockWatcher.ReleaseLock("stepping down for a higher-priority instance")
                 
                 case healthResults, more := <-healthResultsChan:
                     // channel closed if there was an error retrieving the
@@ -194,18 +208,21 @@ func mainLoop(
 
                     if more && haveLock {
                         log.Debug("processing health results")
-                        err := sendHealthResults(riemann, healthResults, updateInterval, nodeName, dc)
+                        err := sinks.Send(healthResults)
                         
                         if err != nil {
-                            log.Errorf("error sending event to Riemann: %v", err)
+                            log.Errorf("error sending health results: %v", err)
                             
-                            lockWatcher.ReleaseLock()
+                            lockWatcher.ReleaseLock(fmt.Sprintf("error sending health results: %v", err))
                         }
                     } else {
                         // lost lock or error occurred retrieving health results
 
+                        reason := "lost lock"
+                        
                         if ! more {
                             log.Info("health checker has stopped")
+                            reason = "health checker has stopped"
                             
                             if healthResultsAbort != nil {
                                 // healthResultsAbort is no longer being read by
@@ -215,7 +232,7 @@ func mainLoop(
                             }
                         }
 
-                        lockWatcher.ReleaseLock()
+                        lockWatcher.ReleaseLock(reason)
                     }
 
                 case <-time.After(updateInterval):
@@ -225,19 +242,288 @@ func mainLoop(
     }
 }
 
+// sends every batch of health results to the sinks, without regard for the
+// lock; only for dry runs
+func lockFreeLoop(healthChecker *HealthChecker, sinks *SinkSet, done chan<- interface{}) {
+    defer func() { close(done) }()
+    defer recoverAndLog("lockFreeLoop")
+    
+    if err := sinks.Open(); err != nil {
+        log.Errorf("unable to open sinks: %v", err)
+        return
+    }
+    
+    defer sinks.Close()
+    
+    healthResultsAbort := make(chan interface{})
+    defer close(healthResultsAbort)
+    
+    for healthResults := range healthChecker.WatchHealthResults(healthResultsAbort) {
+        if err := sinks.Send(healthResults); err != nil {
+            log.Errorf("unable to send health results: %v", err)
+        }
+    }
+    
+    log.Info("health checker has stopped")
+}
+
+// creates the riemann sink, configured by the options
+func newRiemannSink(
+    opts           *Options,
+    dialRiemann    RiemannDialer,
+    updateInterval time.Duration,
+    nodeName       string,
+    dc             string,
+    eventTTL       time.Duration,
+    fencingToken   func() uint64,
+    checkStates    *CheckStateStore,
+    metadata       *ServiceMetadata,
+    nodeMetadata   *NodeMetadata,
+) (*RiemannSink, error) {
+    riemannSink := NewRiemannSink(dialRiemann, updateInterval, nodeName, dc, fencingToken)
+    
+    if err := riemannSink.UseEventTTL(eventTTL); err != nil {
+        return nil, err
+    }
+    
+    if opts.ServiceRollupFormat != "" {
+        if err := riemannSink.UseServiceRollups(opts.ServiceRollupFormat); err != nil {
+            return nil, err
+        }
+    }
+    
+    if err := riemannSink.UseNodeDownMode(opts.NodeDownMode); err != nil {
+        return nil, err
+    }
+    
+    riemannSink.UseMaintenanceState(opts.MaintenanceState)
+    riemannSink.UseCheckStateStore(checkStates)
+    riemannSink.UseExpiredState(opts.ExpiredState)
+    
+    if metadata != nil {
+        riemannSink.UseServiceMetadata(metadata)
+    }
+    
+    if nodeMetadata != nil {
+        riemannSink.UseNodeMetadata(nodeMetadata, opts.NodeMetaAttributes, opts.NodeMetaTags)
+    }
+    
+    flapWindow, err := time.ParseDuration(opts.FlapWindow)
+    if err != nil {
+        return nil, fmt.Errorf("invalid flap window: %v", err)
+    }
+    
+    if flapWindow > 0 {
+        if err := riemannSink.UseFlapDetection(flapWindow, opts.FlapThreshold); err != nil {
+            return nil, err
+        }
+    }
+    
+    if opts.NodeRollupName != "" {
+        riemannSink.UseNodeRollups(opts.NodeRollupName)
+    }
+    
+    outputFilter, err := NewOutputFilter(opts.OutputMaxBytes, opts.OutputMaxLines, opts.OutputRedact)
+    if err != nil {
+        return nil, err
+    }
+    
+    riemannSink.UseOutputFilter(outputFilter)
+    
+    return riemannSink, nil
+}
+
+// creates the sinks named by the --sink options
+func newSinkSet(
+    opts           *Options,
+    dialRiemann    RiemannDialer,
+    updateInterval time.Duration,
+    nodeName       string,
+    dc             string,
+    eventTTL       time.Duration,
+    fencingToken   func() uint64,
+    checkStates    *CheckStateStore,
+    metadata       *ServiceMetadata,
+    nodeMetadata   *NodeMetadata,
+) (*SinkSet, error) {
+    sinks := NewSinkSet()
+    
+    // the prometheus sink is the check state exporter
+    exportCheckStates := opts.ExportCheckStates
+    
+    specs := opts.Sinks
+    if opts.DryRun {
+        // the riemann sink prints its events instead
+        specs = []string{ "riemann" }
+    }
+    
+    for _, spec := range specs {
+        kind, target := parseSinkSpec(spec)
+        
+        switch kind {
+            case "riemann":
+                if opts.RiemannHost == "" && ! opts.DryRun {
+                    return nil, fmt.Errorf("the riemann sink requires --riemann-host")
+                }
+                
+                riemannSink, err := newRiemannSink(opts, dialRiemann, updateInterval, nodeName, dc, eventTTL, fencingToken, checkStates, metadata, nodeMetadata)
+                if err != nil {
+                    return nil, err
+                }
+                
+                sinks.Add(riemannSink)
+            
+            case "file":
+                sinks.Add(NewFileSink(target, nodeName, dc))
+            
+            case "webhook":
+                sinks.Add(NewWebhookSink(target, updateInterval, nodeName, dc, fencingToken))
+            
+            case "transitions":
+                config, err := newTransitionWebhookConfig(opts, target)
+                if err != nil {
+                    return nil, err
+                }
+                
+                sinks.Add(NewTransitionWebhookSink(config, nodeName, dc))
+            
+            case "statsd":
+                sinks.Add(NewStatsdSink(target, opts.MetricPrefix))
+            
+            case "graphite":
+                sinks.Add(NewGraphiteSink(target, opts.MetricPrefix))
+            
+            case "prometheus":
+                exportCheckStates = true
+            
+            default:
+                return nil, fmt.Errorf("unknown sink %s", spec)
+        }
+        
+        if kind != "riemann" && kind != "prometheus" && target == "" {
+            return nil, fmt.Errorf("the %s sink requires a target, e.g. %s:<target>", kind, kind)
+        }
+    }
+    
+    // exposed via /metrics.  it can't fail, so it mustn't keep an outage of
+    // the other sinks from releasing the lock
+    if exportCheckStates && ! opts.DryRun {
+        if opts.HttpAddr == "" {
+            log.Warn("check states are exported, but the HTTP endpoint is disabled")
+        }
+        
+        sinks.AddObserver(NewCheckStateExporter(metrics))
+    }
+    
+    if sinks.Len() == 0 {
+        return nil, fmt.Errorf("no sinks configured")
+    }
+    
+    return sinks, nil
+}
+
+// configures the transition webhook from the --transition-webhook-* options
+func newTransitionWebhookConfig(opts *Options, url string) (TransitionWebhookConfig, error) {
+    config := TransitionWebhookConfig{
+        URL:        url,
+        Retries:    opts.TransitionRetries,
+        RetryDelay: time.Second,
+        Secret:     opts.TransitionSecret,
+        Batch:      opts.TransitionBatch,
+        QueueSize:  opts.TransitionQueueSize,
+    }
+    
+    var err error
+    
+    config.Timeout, err = time.ParseDuration(opts.TransitionTimeout)
+    if err != nil {
+        return config, fmt.Errorf("invalid transition webhook timeout: %v", err)
+    }
+    
+    config.RetryBudget, err = time.ParseDuration(opts.TransitionRetryBudget)
+    if err != nil {
+        return config, fmt.Errorf("invalid transition webhook retry budget: %v", err)
+    }
+    
+    headers, err := parseHeaders(opts.TransitionHeaders)
+    if err != nil {
+        return config, err
+    }
+    
+    config.Headers = headers
+    
+    if opts.TransitionTemplate != "" {
+        text, err := ioutil.ReadFile(opts.TransitionTemplate)
+        if err != nil {
+            return config, fmt.Errorf("unable to read transition webhook template: %v", err)
+        }
+        
+        config.Template, err = parseTransitionTemplate(opts.TransitionTemplate, string(text))
+        if err != nil {
+            return config, fmt.Errorf("invalid transition webhook template: %v", err)
+        }
+    }
+    
+    return config, nil
+}
+
+// opens connections to Riemann using the protocol given by the options
+func newRiemannDialer(opts *Options) (RiemannDialer, error) {
+    riemannAddr := fmt.Sprintf("%s:%d", opts.RiemannHost, opts.RiemannPort)
+    
+    dialRiemannVia := func(proto string) RiemannDialer {
+        return func() (RiemannClient, error) {
+            log.Infof("connecting to Riemann at %s via %s", riemannAddr, proto)
+            
+            riemann, err := raidman.Dial(proto, riemannAddr)
+            if err != nil {
+                return nil, err
+            }
+            
+            return riemann, nil
+        }
+    }
+    
+    return NewAdaptiveRiemannDialer(opts.Proto, dialRiemannVia("udp"), dialRiemannVia("tcp"), opts.UDPMaxSize, opts.Reliable)
+}
+
 func main() {
     var opts Options
     
-    _, err := flags.Parse(&opts)
+    parser := flags.NewParser(&opts, flags.Default)
+    parser.SubcommandsOptional = true
+    
+    _, err := parser.AddCommand(
+        "replay",
+        "send the events for a recorded health snapshot",
+        "Runs a snapshot of Consul's health checks, as returned by /v1/health/state/any, " +
+        "through the same pipeline as live results and prints the resulting Riemann events, " +
+        "or sends them with --send.  Neither a Consul agent nor the lock is needed.  Service " +
+        "metadata comes from the snapshot's Metadata section rather than the KV store.  Every " +
+        "event has a replayed attribute and a fencing token of 0.",
+        &ReplayCommand{ opts: &opts },
+    )
+    checkError("unable to add replay command", err)
+    
+    _, err = parser.Parse()
     if err != nil {
         os.Exit(1)
     }
     
+    // a command was given, and has been run
+    if parser.Active != nil {
+        os.Exit(0)
+    }
+    
     if opts.PrintVersion {
         fmt.Printf("Version: %s\n", version)
         os.Exit(0)
     }
     
+    if opts.SkipLock && ! opts.DryRun {
+        log.Fatal("--skip-lock requires --dry-run")
+    }
+    
     // parse UpdateInterval and LockDelay before setting up logging
     updateInterval, err := time.ParseDuration(opts.UpdateInterval)
     checkError(fmt.Sprintf("invalid update interval %s", opts.UpdateInterval), err)
@@ -245,17 +531,31 @@ func main() {
     lockDelay, err := time.ParseDuration(opts.LockDelay)
     checkError(fmt.Sprintf("invalid lock delay %s", opts.LockDelay), err)
     
+    auditInterval, err := time.ParseDuration(opts.AuditInterval)
+    checkError(fmt.Sprintf("invalid audit interval %s", opts.AuditInterval), err)
+    
     if opts.Debug {
         // Only log the warning severity or above.
         log.SetLevel(log.DebugLevel)
     }
     
+    // where events are printed in a dry run
+    eventOut := os.Stdout
+    
     if opts.LogFile != "" {
         logFp, err := os.OpenFile(opts.LogFile, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
         checkError(fmt.Sprintf("error opening %s", opts.LogFile), err)
         
         defer logFp.Close()
         
+        // keep writing events to the real stdout in a dry run
+        if opts.DryRun {
+            stdoutFd, err := syscall.Dup(1)
+            checkError("unable to duplicate stdout", err)
+            
+            eventOut = os.NewFile(uintptr(stdoutFd), "stdout")
+        }
+        
         // ensure panic output goes to log file
         // https://code.google.com/p/go/issues/detail?id=325
         syscall.Dup2(int(logFp.Fd()), 1)
@@ -286,6 +586,8 @@ func main() {
     consul, err := consulapi.NewClient(consulConfig)
     checkError("unable to create consul client", err)
     
+    catalog := newConsulCatalog(consul, consulConfig)
+    
     // need dc and node name for riemann event attributes
     agentInfo, err := consul.Agent().Self()
     checkError("unable to retrieve agent info", err)
@@ -306,16 +608,178 @@ func main() {
     
     checkError("unable to initialize consul receiver", err)
     
-    healthChecker := NewHealthChecker(consul.Health(), consul.Catalog(), updateInterval)
+    // instances only advertise and compare priorities if asked to
+    if opts.Priority != 0 {
+        lockWatcher.UsePriority(opts.Priority, consul.Health())
+    }
     
-    err = lockWatcher.RegisterService()
-    checkError("unable to register service", err)
+    checkTTL, err := parseTTL(opts.CheckTTL, updateInterval)
+    checkError("invalid check TTL", err)
     
-    _, err = lockWatcher.InitSession()
-    checkError("unable to init session", err)
+    err = lockWatcher.UseCheckTTL(checkTTL)
+    checkError("unable to configure check TTL", err)
     
-    // destroy the session when the process exits
-    defer lockWatcher.DestroySession()
+    eventTTL, err := parseTTL(opts.EventTTL, updateInterval)
+    checkError("invalid event TTL", err)
+    
+    switch opts.SessionMode {
+        case "check":
+            // default
+        
+        case "ttl":
+            sessionTTL := updateInterval * 3
+            
+            if opts.SessionTTL != "" {
+                sessionTTL, err = time.ParseDuration(opts.SessionTTL)
+                checkError(fmt.Sprintf("invalid session TTL %s", opts.SessionTTL), err)
+            }
+            
+            err = lockWatcher.UseSessionTTL(sessionTTL, opts.SessionBehavior)
+            checkError("unable to configure session TTL", err)
+        
+        default:
+            log.Fatalf("invalid session mode %s", opts.SessionMode)
+    }
+    
+    healthChecker := NewHealthChecker(newConsulHealth(consul, consulConfig), catalog, updateInterval)
+    
+    // a ttl session doesn't depend on the service's check, so the service only
+    // needs registering to advertise our priority
+    registered := ! opts.SkipLock && (opts.SessionMode != "ttl" || opts.Priority != 0)
+    
+    if opts.SkipLock {
+        log.Warn("dry run without the lock; health results will be sent regardless of the leader")
+    } else {
+        if registered {
+            err = lockWatcher.RegisterService()
+            checkError("unable to register service", err)
+        }
+        
+        _, err = lockWatcher.InitSession()
+        checkError("unable to init session", err)
+        
+        // destroy the session when the process exits
+        defer lockWatcher.DestroySession()
+    }
+    
+    var dialRiemann RiemannDialer
+    
+    if opts.DryRun {
+        log.Info("dry run; printing events instead of sending them to Riemann")
+        
+        printer := NewEventPrinter(eventOut)
+        dialRiemann = func() (RiemannClient, error) {
+            return printer, nil
+        }
+    } else {
+        dialRiemann, err = newRiemannDialer(&opts)
+        checkError("unable to configure Riemann client", err)
+    }
+    
+    // when each check entered its current status, shared by successive
+    // leaders.  a dry run mustn't touch it, even when it holds the lock.
+    var checkStates *CheckStateStore
+    if ! opts.DryRun {
+        checkStates = NewCheckStateStore(consul.KV(), opts.CheckStatePrefix, lockWatcher.FencingToken)
+    }
+    
+    var metadata *ServiceMetadata
+    if opts.MetadataPrefix != "" {
+        metadata = NewServiceMetadata(consul.KV(), opts.MetadataPrefix, updateInterval)
+    }
+    
+    var nodeMetadata *NodeMetadata
+    if len(opts.NodeMetaAttributes) > 0 || len(opts.NodeMetaTags) > 0 {
+        nodeMetadata = NewNodeMetadata(catalog, updateInterval)
+    }
+    
+    sinks, err := newSinkSet(&opts, dialRiemann, updateInterval, nodeName, dc, eventTTL, lockWatcher.FencingToken, checkStates, metadata, nodeMetadata)
+    checkError("unable to configure sinks", err)
+    
+    // used for events about the receiver itself, which are sent regardless of
+    // whether we hold the lock
+    var notifier *Notifier
+    if opts.RiemannHost != "" || opts.DryRun {
+        notifier = NewNotifier(dialRiemann, eventTTL, nodeName, dc)
+    }
+    
+    statusRegistry := NewStatusRegistry()
+    statusRegistry.Register("version", func() interface{} { return version })
+    statusRegistry.Register("lock", func() interface{} {
+        return map[string]interface{}{
+            "leader":        lockWatcher.HaveLock(),
+            "session":       lockWatcher.SessionID(),
+            "fencing_token": lockWatcher.FencingToken(),
+        }
+    })
+    
+    // send an event for every change in leadership
+    lockWatcher.History().OnTransition(func(transition LeadershipTransition) {
+        if notifier == nil {
+            return
+        }
+        
+        state := "ok"
+        if transition.Type == TransitionLost || transition.Type == TransitionSessionRecreated {
+            state = "warning"
+        }
+        
+        err := notifier.Notify(&raidman.Event{
+            Service:     lockWatcher.ServiceName() + " leadership",
+            State:       state,
+            Description: transition.Reason,
+            Attributes:  map[string]string{
+                "transition":    transition.Type,
+                "session":       transition.Session,
+                "fencing_token": strconv.FormatUint(transition.FencingToken, 10),
+            },
+        })
+        
+        if err != nil {
+            log.Errorf("unable to send leadership transition event: %v", err)
+        }
+    })
+    
+    // closed when main() returns, to stop background routines
+    stopChan := make(chan interface{})
+    defer close(stopChan)
+    
+    if auditInterval > 0 && ! opts.SkipLock {
+        lockAuditor := NewLockAuditor(
+            lockWatcher,
+            consul.KV(),
+            consul.Session(),
+            catalog,
+            registered,
+            notifier,
+            auditInterval,
+        )
+        
+        statusRegistry.Register("lock_audit", lockAuditor.Status)
+        
+        go lockAuditor.Run(stopChan)
+    }
+    
+    if metadata != nil {
+        go metadata.Watch(stopChan)
+    }
+    
+    if nodeMetadata != nil {
+        go nodeMetadata.Watch(stopChan)
+    }
+    
+    if opts.HttpAddr != "" {
+        mux := http.NewServeMux()
+        mux.Handle("/status", statusRegistry)
+        mux.Handle("/leadership", lockWatcher.History())
+        mux.Handle("/metrics", metrics)
+        
+        log.Infof("serving status on %s", opts.HttpAddr)
+        
+        go func() {
+            checkError("status HTTP server failed", http.ListenAndServe(opts.HttpAddr, mux))
+        }()
+    }
     
     // receive OS signals so we can cleanly shut down
     // use syscall signals because os only provides Interrupt and Kill
@@ -325,7 +789,11 @@ func main() {
     log.Debug("starting main loop")
 
     done := make(chan interface{})
-    go mainLoop(lockWatcher, healthChecker, opts.RiemannHost, opts.RiemannPort, opts.Proto, updateInterval, nodeName, dc, done)
+    if opts.SkipLock {
+        go lockFreeLoop(healthChecker, sinks, done)
+    } else {
+        go mainLoop(lockWatcher, healthChecker, sinks, updateInterval, registered, done)
+    }
     
     // Block until a signal is received or mainLoop crashes
     select {
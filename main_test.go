@@ -0,0 +1,102 @@
+package main
+
+import (
+    "time"
+    "bytes"
+    "errors"
+    
+    flags "github.com/jessevdk/go-flags"
+    "github.com/stretchr/testify/mock"
+    "github.com/armon/consul-api"
+    "github.com/bluestatedigital/riemann-consul-receiver/consul-mocks"
+)
+
+var _ = Describe("main", func() {
+    var opts Options
+    
+    fencingToken := func() uint64 { return 1 }
+    
+    BeforeEach(func() {
+        opts = Options{}
+        
+        _, err := flags.ParseArgs(&opts, []string{})
+        Expect(err).To(BeNil())
+    })
+    
+    Describe("dry run sinks", func() {
+        var out *bytes.Buffer
+        var dialPrinter RiemannDialer
+        
+        BeforeEach(func() {
+            out = new(bytes.Buffer)
+            
+            printer := NewEventPrinter(out)
+            dialPrinter = func() (RiemannClient, error) {
+                return printer, nil
+            }
+            
+            opts.DryRun = true
+            opts.Sinks = []string{ "file:/tmp/results", "webhook:http://localhost/", "prometheus" }
+        })
+        
+        It("prints the riemann sink's events and drops the other sinks", func() {
+            sinks, err := newSinkSet(&opts, dialPrinter, time.Minute, "some-node", "dc1", 3 * time.Minute, fencingToken, nil, nil, nil)
+            Expect(err).To(BeNil())
+            Expect(sinks.Len()).To(Equal(1))
+            
+            _, isRiemann := sinks.sinks[0].(*RiemannSink)
+            Expect(isRiemann).To(BeTrue())
+            
+            Expect(sinks.Open()).To(BeNil())
+            Expect(sinks.Send([]HealthCheck{
+                HealthCheck{ Node: "node1", CheckID: "serfHealth", Status: "passing" },
+            })).To(BeNil())
+            
+            Expect(out.String()).To(ContainSubstring(`"service":"serfHealth"`))
+        })
+        
+        It("doesn't require a Riemann host", func() {
+            opts.RiemannHost = ""
+            
+            _, err := newSinkSet(&opts, dialPrinter, time.Minute, "some-node", "dc1", 3 * time.Minute, fencingToken, nil, nil, nil)
+            Expect(err).To(BeNil())
+        })
+    })
+    
+    Describe("lockFreeLoop", func() {
+        It("sends every batch of health results until the health checker stops", func(done Done) {
+            mockHealth := consulmocks.MockHealth{}
+            mockCatalog := consulmocks.MockCatalog{}
+            
+            queryOpts := mock.AnythingOfType("*consulapi.QueryOptions")
+            
+            mockHealth.On("State", "any", queryOpts).Return(
+                []*consulapi.HealthCheck{
+                    &consulapi.HealthCheck{ Node: "node1", CheckID: "serfHealth", Status: "passing" },
+                },
+                &consulapi.QueryMeta{ LastIndex: 10 },
+                nil,
+            ).Once()
+            
+            mockHealth.On("State", "any", queryOpts).Return(
+                []*consulapi.HealthCheck(nil),
+                (*consulapi.QueryMeta)(nil),
+                errors.New("no leader"),
+            )
+            
+            sink := &fakeSink{ name: "some-sink" }
+            loopDone := make(chan interface{})
+            
+            go lockFreeLoop(NewHealthChecker(&mockHealth, &mockCatalog, time.Minute), NewSinkSet(sink), loopDone)
+            
+            <-loopDone
+            
+            Expect(sink.opened).To(Equal(1))
+            Expect(sink.batches).To(HaveLen(1))
+            Expect(sink.batches[0][0].CheckID).To(Equal("serfHealth"))
+            Expect(sink.closed).To(Equal(1))
+            
+            close(done)
+        })
+    })
+})
@@ -0,0 +1,63 @@
+package main
+
+import (
+    "strings"
+)
+
+// Consul registers these critical checks when a node or service is put into
+// maintenance mode, with the reason in the notes.
+const (
+    nodeMaintenanceCheckID        = "_node_maintenance"
+    serviceMaintenanceCheckPrefix = "_service_maintenance:"
+)
+
+func isMaintenanceCheck(checkID string) bool {
+    return checkID == nodeMaintenanceCheckID || strings.HasPrefix(checkID, serviceMaintenanceCheckPrefix)
+}
+
+// the nodes and service instances in maintenance mode, with their reasons
+type maintenanceSet struct {
+    nodes    map[string]string
+    services map[nodeServiceKey]string
+}
+
+func findMaintenance(healthResults []HealthCheck) *maintenanceSet {
+    maint := &maintenanceSet{
+        nodes:    make(map[string]string),
+        services: make(map[nodeServiceKey]string),
+    }
+    
+    for _, healthCheck := range healthResults {
+        if healthCheck.CheckID == nodeMaintenanceCheckID {
+            maint.nodes[healthCheck.Node] = healthCheck.Notes
+        } else if strings.HasPrefix(healthCheck.CheckID, serviceMaintenanceCheckPrefix) {
+            serviceID := healthCheck.ServiceID
+            if serviceID == "" {
+                serviceID = strings.TrimPrefix(healthCheck.CheckID, serviceMaintenanceCheckPrefix)
+            }
+            
+            maint.services[nodeServiceKey{ healthCheck.Node, serviceID }] = healthCheck.Notes
+        }
+    }
+    
+    return maint
+}
+
+// returns the maintenance reason for the check, and whether its node or
+// service is in maintenance mode at all
+func (self *maintenanceSet) reason(healthCheck HealthCheck) (string, bool) {
+    if reason, found := self.nodes[healthCheck.Node]; found {
+        return reason, true
+    }
+    
+    if healthCheck.ServiceID != "" {
+        reason, found := self.services[nodeServiceKey{ healthCheck.Node, healthCheck.ServiceID }]
+        return reason, found
+    }
+    
+    if strings.HasPrefix(healthCheck.CheckID, serviceMaintenanceCheckPrefix) {
+        return healthCheck.Notes, true
+    }
+    
+    return "", false
+}
@@ -0,0 +1,39 @@
+package main
+
+var _ = Describe("maintenance mode", func() {
+    healthResults := []HealthCheck{
+        HealthCheck{ Node: "node1", CheckID: "_node_maintenance", Status: "critical", Notes: "kernel upgrade" },
+        HealthCheck{ Node: "node1", CheckID: "service:web", Status: "critical", ServiceID: "web", ServiceName: "web" },
+        HealthCheck{ Node: "node2", CheckID: "_service_maintenance:web", Status: "critical", Notes: "deploying", ServiceID: "web", ServiceName: "web" },
+        HealthCheck{ Node: "node2", CheckID: "service:web", Status: "critical", ServiceID: "web", ServiceName: "web" },
+        HealthCheck{ Node: "node2", CheckID: "service:db", Status: "critical", ServiceID: "db", ServiceName: "db" },
+    }
+    
+    It("recognizes maintenance checks", func() {
+        Expect(isMaintenanceCheck("_node_maintenance")).To(Equal(true))
+        Expect(isMaintenanceCheck("_service_maintenance:web")).To(Equal(true))
+        Expect(isMaintenanceCheck("service:web")).To(Equal(false))
+    })
+    
+    It("finds the reason for node and service maintenance", func() {
+        maint := findMaintenance(healthResults)
+        
+        reason, found := maint.reason(healthResults[1])
+        Expect(found).To(Equal(true))
+        Expect(reason).To(Equal("kernel upgrade"))
+        
+        reason, found = maint.reason(healthResults[3])
+        Expect(found).To(Equal(true))
+        Expect(reason).To(Equal("deploying"))
+        
+        _, found = maint.reason(healthResults[4])
+        Expect(found).To(Equal(false))
+    })
+    
+    It("ignores maintenance checks in rollups", func() {
+        rollups := nodeRollups(healthResults)
+        
+        Expect(rollups["node1"].Checks.Total).To(Equal(1))
+        Expect(rollups["node2"].Checks.Total).To(Equal(2))
+    })
+})
@@ -0,0 +1,159 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "time"
+    "bytes"
+    "strings"
+)
+
+// MetricLineSink sends the status of each check as a numeric gauge to StatsD
+// (over UDP) or Graphite (plaintext protocol over TCP): 0 for passing, 1 for
+// warning and 2 for critical, named <prefix>.<node>.<check id>.  The number of
+// checks in each status is sent as <prefix>.checks.<status>.
+type MetricLineSink struct {
+    format string
+    proto  string
+    addr   string
+    prefix string
+    conn   net.Conn
+}
+
+// how long a write may take before the connection is given up on; a stalled
+// Graphite server mustn't hold up the other sinks
+const metricLineWriteTimeout = 10 * time.Second
+
+var statusValues = map[string]int{
+    "passing":  0,
+    "warning":  1,
+    "critical": 2,
+}
+
+func NewStatsdSink(addr, prefix string) *MetricLineSink {
+    return &MetricLineSink{
+        format: "statsd",
+        proto:  "udp",
+        addr:   addr,
+        prefix: prefix,
+    }
+}
+
+func NewGraphiteSink(addr, prefix string) *MetricLineSink {
+    return &MetricLineSink{
+        format: "graphite",
+        proto:  "tcp",
+        addr:   addr,
+        prefix: prefix,
+    }
+}
+
+func (self *MetricLineSink) Name() string {
+    return self.format
+}
+
+func (self *MetricLineSink) Open() error {
+    if self.conn != nil {
+        return nil
+    }
+    
+    conn, err := net.DialTimeout(self.proto, self.addr, 10 * time.Second)
+    if err != nil {
+        return err
+    }
+    
+    self.conn = conn
+    
+    return nil
+}
+
+func (self *MetricLineSink) Send(healthResults []HealthCheck) error {
+    if err := self.Open(); err != nil {
+        return err
+    }
+    
+    var err error
+    lines := self.formatLines(healthResults, time.Now())
+    
+    self.conn.SetWriteDeadline(time.Now().Add(metricLineWriteTimeout))
+    
+    if self.format == "statsd" {
+        // one metric per datagram keeps us well clear of the MTU
+        for _, line := range lines {
+            if _, err = self.conn.Write([]byte(line)); err != nil {
+                break
+            }
+        }
+    } else {
+        _, err = self.conn.Write([]byte(strings.Join(lines, "")))
+    }
+    
+    if err != nil {
+        self.Close()
+    }
+    
+    return err
+}
+
+func (self *MetricLineSink) Close() {
+    if self.conn != nil {
+        self.conn.Close()
+        self.conn = nil
+    }
+}
+
+func (self *MetricLineSink) formatLines(healthResults []HealthCheck, now time.Time) []string {
+    var lines []string
+    
+    counts := make(map[string]int)
+    for status := range statusValues {
+        counts[status] = 0
+    }
+    
+    for _, healthCheck := range healthResults {
+        value, known := statusValues[healthCheck.Status]
+        if ! known {
+            continue
+        }
+        
+        counts[healthCheck.Status] += 1
+        
+        name := strings.Join([]string{
+            self.prefix,
+            sanitizeMetricComponent(healthCheck.Node),
+            sanitizeMetricComponent(healthCheck.CheckID),
+        }, ".")
+        
+        lines = append(lines, self.formatLine(name, value, now))
+    }
+    
+    for _, status := range consulStatuses {
+        lines = append(lines, self.formatLine(self.prefix + ".checks." + status, counts[status], now))
+    }
+    
+    return lines
+}
+
+func (self *MetricLineSink) formatLine(name string, value int, now time.Time) string {
+    if self.format == "statsd" {
+        return fmt.Sprintf("%s:%d|g\n", name, value)
+    }
+    
+    return fmt.Sprintf("%s %d %d\n", name, value, now.Unix())
+}
+
+// replaces characters that have meaning in metric names (like the dots in
+// node names) with underscores
+func sanitizeMetricComponent(component string) string {
+    var buf bytes.Buffer
+    
+    for _, r := range component {
+        if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+            buf.WriteRune(r)
+        } else {
+            buf.WriteRune('_')
+        }
+    }
+    
+    return buf.String()
+}
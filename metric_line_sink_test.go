@@ -0,0 +1,31 @@
+package main
+
+import (
+    "time"
+)
+
+var _ = Describe("MetricLineSink", func() {
+    now := time.Unix(1420070400, 0)
+    
+    healthResults := []HealthCheck{
+        HealthCheck{ Node: "web1.example.com", CheckID: "service:nginx", Status: "critical" },
+        HealthCheck{ Node: "web1.example.com", CheckID: "serfHealth", Status: "passing" },
+    }
+    
+    It("formats StatsD gauges", func() {
+        lines := NewStatsdSink("127.0.0.1:8125", "consul").formatLines(healthResults, now)
+        
+        Expect(lines).To(ContainElement("consul.web1_example_com.service_nginx:2|g\n"))
+        Expect(lines).To(ContainElement("consul.web1_example_com.serfHealth:0|g\n"))
+        Expect(lines).To(ContainElement("consul.checks.passing:1|g\n"))
+        Expect(lines).To(ContainElement("consul.checks.warning:0|g\n"))
+        Expect(lines).To(ContainElement("consul.checks.critical:1|g\n"))
+    })
+    
+    It("formats Graphite lines", func() {
+        lines := NewGraphiteSink("127.0.0.1:2003", "consul").formatLines(healthResults, now)
+        
+        Expect(lines).To(ContainElement("consul.web1_example_com.service_nginx 2 1420070400\n"))
+        Expect(lines).To(ContainElement("consul.checks.passing 1 1420070400\n"))
+    })
+})
@@ -0,0 +1,361 @@
+package main
+
+import (
+    "io"
+    "fmt"
+    "sort"
+    "sync"
+    "math"
+    "bytes"
+    "strings"
+    "strconv"
+    "net/http"
+)
+
+// A minimal implementation of Prometheus metrics, rendered in the text
+// exposition format.  Each metric can have a set of labels; values are kept
+// per combination of label values, which must be passed in the same order as
+// the label names.
+
+type metricWriter interface {
+    writeTo(w io.Writer)
+}
+
+type MetricsRegistry struct {
+    lock    sync.RWMutex
+    metrics []metricWriter
+    names   map[string]bool
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+    return &MetricsRegistry{
+        names: make(map[string]bool),
+    }
+}
+
+func (self *MetricsRegistry) register(name string, metric metricWriter) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    
+    if self.names[name] {
+        panic(fmt.Sprintf("metric %s registered twice", name))
+    }
+    
+    self.names[name] = true
+    self.metrics = append(self.metrics, metric)
+}
+
+func (self *MetricsRegistry) Render(w io.Writer) {
+    self.lock.RLock()
+    defer self.lock.RUnlock()
+    
+    for _, metric := range self.metrics {
+        metric.writeTo(w)
+    }
+}
+
+func (self *MetricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var buf bytes.Buffer
+    self.Render(&buf)
+    
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    w.Write(buf.Bytes())
+}
+
+// values common to all metric types
+type metricVec struct {
+    name       string
+    help       string
+    metricType string
+    labelNames []string
+    
+    lock sync.Mutex
+}
+
+// key used to store values for a set of label values
+func (self *metricVec) key(labelValues []string) string {
+    if len(labelValues) != len(self.labelNames) {
+        panic(fmt.Sprintf("%s: expected %d label values, got %d", self.name, len(self.labelNames), len(labelValues)))
+    }
+    
+    return strings.Join(labelValues, "\xff")
+}
+
+func (self *metricVec) writeHeader(w io.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n", self.name, escapeHelp(self.help))
+    fmt.Fprintf(w, "# TYPE %s %s\n", self.name, self.metricType)
+}
+
+// formats the labels, including any extra name/value pairs
+func (self *metricVec) formatLabels(labelValues []string, extra ...string) string {
+    var pairs []string
+    
+    for i, name := range self.labelNames {
+        pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(labelValues[i])))
+    }
+    
+    for i := 0; i + 1 < len(extra); i += 2 {
+        pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[i], escapeLabelValue(extra[i + 1])))
+    }
+    
+    if len(pairs) == 0 {
+        return ""
+    }
+    
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeHelp(help string) string {
+    return strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+    return strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"").Replace(value)
+}
+
+func formatMetricValue(value float64) string {
+    switch {
+        case math.IsInf(value, 1):
+            return "+Inf"
+        
+        case math.IsInf(value, -1):
+            return "-Inf"
+        
+        case math.IsNaN(value):
+            return "NaN"
+    }
+    
+    return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// a value along with the label values it's stored for
+type labeledValue struct {
+    labelValues []string
+    value       float64
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+    metricVec
+    values map[string]*labeledValue
+}
+
+func (self *MetricsRegistry) NewGauge(name, help string, labelNames ...string) *Gauge {
+    gauge := newGauge(name, help, "gauge", labelNames)
+    self.register(name, gauge)
+    
+    return gauge
+}
+
+func newGauge(name, help, metricType string, labelNames []string) *Gauge {
+    return &Gauge{
+        metricVec: metricVec{
+            name:       name,
+            help:       help,
+            metricType: metricType,
+            labelNames: labelNames,
+        },
+        values: make(map[string]*labeledValue),
+    }
+}
+
+// returns the value for the label values, creating it if necessary.  must be
+// called with the lock held.
+func (self *Gauge) get(labelValues []string) *labeledValue {
+    key := self.key(labelValues)
+    
+    value, exists := self.values[key]
+    if ! exists {
+        value = &labeledValue{
+            labelValues: append([]string(nil), labelValues...),
+        }
+        
+        self.values[key] = value
+    }
+    
+    return value
+}
+
+func (self *Gauge) Set(value float64, labelValues ...string) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    
+    self.get(labelValues).value = value
+}
+
+func (self *Gauge) Add(delta float64, labelValues ...string) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    
+    self.get(labelValues).value += delta
+}
+
+// the value for the label values; 0 if it was never set.  doesn't create it.
+func (self *Gauge) Value(labelValues ...string) float64 {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    
+    if value, exists := self.values[self.key(labelValues)]; exists {
+        return value.value
+    }
+    
+    return 0
+}
+
+// removes all values
+func (self *Gauge) Reset() {
+    self.ReplaceAll(nil)
+}
+
+// replaces all values at once, so a scrape never sees a partial set
+func (self *Gauge) ReplaceAll(values []labeledValue) {
+    newValues := make(map[string]*labeledValue)
+    
+    for i := range values {
+        newValues[self.key(values[i].labelValues)] = &values[i]
+    }
+    
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    
+    self.values = newValues
+}
+
+func (self *Gauge) writeTo(w io.Writer) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    
+    self.writeHeader(w)
+    
+    keys := make([]string, 0, len(self.values))
+    for key := range self.values {
+        keys = append(keys, key)
+    }
+    
+    sort.Strings(keys)
+    
+    for _, key := range keys {
+        value := self.values[key]
+        fmt.Fprintf(w, "%s%s %s\n", self.name, self.formatLabels(value.labelValues), formatMetricValue(value.value))
+    }
+}
+
+// Counter is a value that only goes up.  its values are kept in a Gauge, but
+// only Inc and Add are exposed.
+type Counter struct {
+    gauge *Gauge
+}
+
+func (self *MetricsRegistry) NewCounter(name, help string, labelNames ...string) *Counter {
+    counter := &Counter{ newGauge(name, help, "counter", labelNames) }
+    self.register(name, counter)
+    
+    return counter
+}
+
+func (self *Counter) Inc(labelValues ...string) {
+    self.gauge.Add(1, labelValues...)
+}
+
+func (self *Counter) Add(delta float64, labelValues ...string) {
+    if delta < 0 {
+        panic(fmt.Sprintf("%s: counters cannot decrease", self.gauge.name))
+    }
+    
+    self.gauge.Add(delta, labelValues...)
+}
+
+func (self *Counter) Value(labelValues ...string) float64 {
+    return self.gauge.Value(labelValues...)
+}
+
+func (self *Counter) writeTo(w io.Writer) {
+    self.gauge.writeTo(w)
+}
+
+// Histogram counts observations in buckets and tracks their sum.
+type Histogram struct {
+    metricVec
+    buckets []float64
+    values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+    labelValues []string
+    counts      []uint64
+    count       uint64
+    sum         float64
+}
+
+// default buckets, in seconds, suitable for request latencies
+var DefaultLatencyBuckets = []float64{ .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120 }
+
+func (self *MetricsRegistry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+    histogram := &Histogram{
+        metricVec: metricVec{
+            name:       name,
+            help:       help,
+            metricType: "histogram",
+            labelNames: labelNames,
+        },
+        buckets: buckets,
+        values:  make(map[string]*histogramValue),
+    }
+    
+    self.register(name, histogram)
+    
+    return histogram
+}
+
+func (self *Histogram) Observe(value float64, labelValues ...string) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    
+    key := self.key(labelValues)
+    
+    hv, exists := self.values[key]
+    if ! exists {
+        hv = &histogramValue{
+            labelValues: append([]string(nil), labelValues...),
+            counts:      make([]uint64, len(self.buckets)),
+        }
+        
+        self.values[key] = hv
+    }
+    
+    for i, upperBound := range self.buckets {
+        if value <= upperBound {
+            hv.counts[i] += 1
+        }
+    }
+    
+    hv.count += 1
+    hv.sum += value
+}
+
+func (self *Histogram) writeTo(w io.Writer) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    
+    self.writeHeader(w)
+    
+    keys := make([]string, 0, len(self.values))
+    for key := range self.values {
+        keys = append(keys, key)
+    }
+    
+    sort.Strings(keys)
+    
+    for _, key := range keys {
+        hv := self.values[key]
+        
+        // bucket counts are cumulative
+        for i, upperBound := range self.buckets {
+            fmt.Fprintf(w, "%s_bucket%s %d\n", self.name, self.formatLabels(hv.labelValues, "le", formatMetricValue(upperBound)), hv.counts[i])
+        }
+        
+        fmt.Fprintf(w, "%s_bucket%s %d\n", self.name, self.formatLabels(hv.labelValues, "le", "+Inf"), hv.count)
+        fmt.Fprintf(w, "%s_sum%s %s\n", self.name, self.formatLabels(hv.labelValues), formatMetricValue(hv.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", self.name, self.formatLabels(hv.labelValues), hv.count)
+    }
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "bytes"
+    
+    "github.com/armon/consul-api"
+)
+
+var _ = Describe("MetricsRegistry", func() {
+    var registry *MetricsRegistry
+    
+    BeforeEach(func() {
+        registry = NewMetricsRegistry()
+    })
+    
+    render := func() string {
+        var buf bytes.Buffer
+        registry.Render(&buf)
+        
+        return buf.String()
+    }
+    
+    It("renders counters with labels", func() {
+        counter := registry.NewCounter("requests_total", "Requests made.", "call")
+        
+        counter.Inc("foo")
+        counter.Inc("foo")
+        counter.Inc("b\"ar")
+        
+        Expect(render()).To(Equal(
+            "# HELP requests_total Requests made.\n" +
+            "# TYPE requests_total counter\n" +
+            "requests_total{call=\"b\\\"ar\"} 1\n" +
+            "requests_total{call=\"foo\"} 2\n",
+        ))
+    })
+    
+    It("renders gauges without labels", func() {
+        gauge := registry.NewGauge("leader", "Leadership.")
+        gauge.Set(1)
+        
+        Expect(render()).To(ContainSubstring("# TYPE leader gauge\nleader 1\n"))
+    })
+    
+    It("reads a value without creating it", func() {
+        gauge := registry.NewGauge("leader", "Leadership.", "node")
+        
+        Expect(gauge.Value("some-node")).To(Equal(float64(0)))
+        Expect(render()).To(Equal("# HELP leader Leadership.\n# TYPE leader gauge\n"))
+    })
+    
+    It("renders cumulative histogram buckets", func() {
+        histogram := registry.NewHistogram("latency_seconds", "Latency.", []float64{ 0.1, 1 }, "call")
+        
+        histogram.Observe(0.05, "foo")
+        histogram.Observe(0.5, "foo")
+        histogram.Observe(5, "foo")
+        
+        output := render()
+        Expect(output).To(ContainSubstring("latency_seconds_bucket{call=\"foo\",le=\"0.1\"} 1\n"))
+        Expect(output).To(ContainSubstring("latency_seconds_bucket{call=\"foo\",le=\"1\"} 2\n"))
+        Expect(output).To(ContainSubstring("latency_seconds_bucket{call=\"foo\",le=\"+Inf\"} 3\n"))
+        Expect(output).To(ContainSubstring("latency_seconds_sum{call=\"foo\"} 5.55\n"))
+        Expect(output).To(ContainSubstring("latency_seconds_count{call=\"foo\"} 3\n"))
+    })
+    
+    It("rejects the wrong number of label values", func() {
+        counter := registry.NewCounter("requests_total", "Requests made.", "call")
+        
+        Expect(func() { counter.Inc() }).To(Panic())
+    })
+    
+    It("rejects duplicate metrics", func() {
+        registry.NewCounter("requests_total", "Requests made.")
+        
+        Expect(func() { registry.NewGauge("requests_total", "Requests made.") }).To(Panic())
+    })
+})
+
+var _ = Describe("observeBlockingQuery", func() {
+    It("records how far the index moved past the one waited on", func() {
+        observeBlockingQuery("some_call", 100, &consulapi.QueryMeta{ LastIndex: 105 })
+        Expect(metricBlockingQueryIndexLag.Value("some_call")).To(Equal(float64(5)))
+        
+        // went backwards
+        observeBlockingQuery("some_call", 100, &consulapi.QueryMeta{ LastIndex: 3 })
+        Expect(metricBlockingQueryIndexLag.Value("some_call")).To(Equal(float64(0)))
+    })
+    
+    It("ignores the first query of a watch", func() {
+        observeBlockingQuery("first_call", 0, &consulapi.QueryMeta{ LastIndex: 105 })
+        
+        var buf bytes.Buffer
+        metrics.Render(&buf)
+        Expect(buf.String()).NotTo(ContainSubstring("first_call"))
+    })
+})
@@ -0,0 +1,29 @@
+package main
+
+// what the Riemann sink does with a node's other checks when its serfHealth
+// check is critical.  when a node goes away all of its checks fail with it,
+// which makes for a lot of noise about what's really a single problem.
+const (
+    // send them as usual
+    NodeDownSend     = "send"
+    
+    // send them with the "suppressed" tag and a suppressed_by attribute
+    NodeDownTag      = "tag"
+    
+    // don't send them; list them in the serfHealth event's
+    // suppressed_checks attribute instead
+    NodeDownCollapse = "collapse"
+)
+
+// nodes whose serfHealth check is critical
+func downNodes(healthResults []HealthCheck) map[string]bool {
+    down := make(map[string]bool)
+    
+    for _, healthCheck := range healthResults {
+        if healthCheck.CheckID == "serfHealth" && healthCheck.Status == "critical" {
+            down[healthCheck.Node] = true
+        }
+    }
+    
+    return down
+}
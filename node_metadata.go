@@ -0,0 +1,62 @@
+package main
+
+import (
+    "sync"
+    "time"
+
+    "github.com/armon/consul-api"
+)
+
+// NodeMetadata keeps a copy of each node's metadata (rack, availability zone,
+// environment and the like) up to date with blocking queries, so selected keys
+// can be added to the events for every check on the node.
+type NodeMetadata struct {
+    catalog        ConsulCatalog
+    updateInterval time.Duration
+    
+    lock sync.RWMutex
+    meta map[string]map[string]string
+}
+
+func NewNodeMetadata(catalog ConsulCatalog, updateInterval time.Duration) *NodeMetadata {
+    return &NodeMetadata{
+        catalog:        catalog,
+        updateInterval: updateInterval,
+        meta:           make(map[string]map[string]string),
+    }
+}
+
+// the node's metadata; must not be modified
+func (self *NodeMetadata) Meta(node string) map[string]string {
+    self.lock.RLock()
+    defer self.lock.RUnlock()
+    
+    return self.meta[node]
+}
+
+// retrieves the metadata, blocking for up to the update interval if waitIdx is
+// non-zero and nothing has changed.  returns the index for the next call.
+func (self *NodeMetadata) Refresh(waitIdx uint64) (uint64, error) {
+    start := time.Now()
+    meta, queryMeta, err := self.catalog.NodeMeta(&consulapi.QueryOptions{
+        WaitIndex: waitIdx,
+        WaitTime:  self.updateInterval,
+    })
+    observeConsulCall("catalog_nodes", start, queryMeta, err)
+    observeBlockingQuery("catalog_nodes", waitIdx, queryMeta)
+    
+    if err != nil {
+        return waitIdx, err
+    }
+    
+    self.lock.Lock()
+    self.meta = meta
+    self.lock.Unlock()
+    
+    return queryMeta.LastIndex, nil
+}
+
+// keeps the metadata up to date until done is closed
+func (self *NodeMetadata) Watch(done <-chan interface{}) {
+    watchBlockingQuery(done, self.updateInterval, "unable to retrieve node metadata", self.Refresh)
+}
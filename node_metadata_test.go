@@ -0,0 +1,61 @@
+package main
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/stretchr/testify/mock"
+    "github.com/armon/consul-api"
+    "github.com/bluestatedigital/riemann-consul-receiver/consul-mocks"
+)
+
+var _ = Describe("NodeMetadata", func() {
+    var mockCatalog consulmocks.MockCatalog
+    var nodeMetadata *NodeMetadata
+    
+    genericQueryOpts := mock.AnythingOfType("*consulapi.QueryOptions")
+    
+    BeforeEach(func() {
+        mockCatalog = consulmocks.MockCatalog{}
+        nodeMetadata = NewNodeMetadata(&mockCatalog, time.Minute)
+    })
+    
+    It("caches node metadata using blocking queries", func() {
+        mockCatalog.On("NodeMeta", genericQueryOpts).Return(
+            map[string]map[string]string{
+                "node1": map[string]string{ "rack": "r1" },
+            },
+            &consulapi.QueryMeta{ LastIndex: 42 },
+            nil,
+        )
+        
+        waitIdx, err := nodeMetadata.Refresh(7)
+        Expect(err).To(BeNil())
+        Expect(waitIdx).To(Equal(uint64(42)))
+        Expect(nodeMetadata.Meta("node1")).To(HaveKeyWithValue("rack", "r1"))
+        Expect(nodeMetadata.Meta("node2")).To(BeEmpty())
+        
+        opts := mockCatalog.Calls[0].Arguments.Get(0).(*consulapi.QueryOptions)
+        Expect(opts.WaitIndex).To(Equal(uint64(7)))
+        Expect(opts.WaitTime).To(Equal(time.Minute))
+    })
+    
+    It("keeps the previous metadata on error", func() {
+        mockCatalog.On("NodeMeta", genericQueryOpts).Return(
+            map[string]map[string]string{
+                "node1": map[string]string{ "rack": "r1" },
+            },
+            &consulapi.QueryMeta{ LastIndex: 42 },
+            nil,
+        ).Once()
+        
+        mockCatalog.On("NodeMeta", genericQueryOpts).Return(nil, nil, fmt.Errorf("no leader")).Once()
+        
+        nodeMetadata.Refresh(0)
+        
+        waitIdx, err := nodeMetadata.Refresh(42)
+        Expect(err).NotTo(BeNil())
+        Expect(waitIdx).To(Equal(uint64(42)))
+        Expect(nodeMetadata.Meta("node1")).To(HaveKeyWithValue("rack", "r1"))
+    })
+})
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "time"
+
+    "github.com/amir/raidman"
+)
+
+// Notifier sends one-off events about the receiver itself (lock anomalies and
+// the like) to Riemann.  These need to go out whether or not this instance
+// holds the lock, so a new connection is made for each event rather than
+// sharing the one used by the main loop.
+type Notifier struct {
+    dial     RiemannDialer
+    ttl      time.Duration
+    nodeName string
+    dc       string
+}
+
+func NewNotifier(dial RiemannDialer, ttl time.Duration, nodeName, dc string) *Notifier {
+    return &Notifier{
+        dial:     dial,
+        ttl:      ttl,
+        nodeName: nodeName,
+        dc:       dc,
+    }
+}
+
+// fills in the host, time, ttl and standard attributes and sends the event.
+func (self *Notifier) Notify(evt *raidman.Event) error {
+    if evt.Host == "" {
+        evt.Host = self.nodeName
+    }
+    
+    if evt.Ttl == 0 {
+        evt.Ttl = riemannTTL(self.ttl)
+    }
+    
+    evt.Time = time.Now().Unix()
+    evt.Tags = append(evt.Tags, "consul", "riemann-consul-receiver")
+    
+    if evt.Attributes == nil {
+        evt.Attributes = make(map[string]string)
+    }
+    
+    evt.Attributes["reporting_node"] = self.nodeName
+    evt.Attributes["datacenter"] = self.dc
+    
+    riemann, err := self.dial()
+    if err != nil {
+        return err
+    }
+    
+    defer riemann.Close()
+    
+    return riemann.Send(evt)
+}
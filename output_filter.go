@@ -0,0 +1,135 @@
+package main
+
+import (
+    "fmt"
+    "bytes"
+    "regexp"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+)
+
+// appended to output that's been cut short
+const truncationMarker = " [truncated]"
+
+// replaces whatever a redaction pattern matches
+const redactionMarker = "[REDACTED]"
+
+// OutputFilter cleans up check output before it's used as an event's
+// description.  scripts can produce kilobytes of output, terminal escapes and
+// the occasional password, none of which we want to send to Riemann.
+type OutputFilter struct {
+    // limits on the output's size; unlimited if zero
+    maxBytes int
+    maxLines int
+    
+    redact []*regexp.Regexp
+}
+
+func NewOutputFilter(maxBytes, maxLines int, redactPatterns []string) (*OutputFilter, error) {
+    if maxBytes < 0 || maxLines < 0 {
+        return nil, fmt.Errorf("output limits must not be negative")
+    }
+    
+    if maxBytes > 0 && maxBytes <= len(truncationMarker) {
+        return nil, fmt.Errorf("output byte limit must be greater than %d", len(truncationMarker))
+    }
+    
+    filter := &OutputFilter{
+        maxBytes: maxBytes,
+        maxLines: maxLines,
+    }
+    
+    for _, pattern := range redactPatterns {
+        re, err := regexp.Compile(pattern)
+        if err != nil {
+            return nil, fmt.Errorf("invalid redaction pattern %q: %v", pattern, err)
+        }
+        
+        filter.redact = append(filter.redact, re)
+    }
+    
+    return filter, nil
+}
+
+// strips control characters, redacts, then truncates.  redacting first means a
+// secret can't survive by being cut in half.
+func (self *OutputFilter) Filter(output string) string {
+    output = stripControlChars(output)
+    
+    for _, re := range self.redact {
+        output = re.ReplaceAllString(output, redactionMarker)
+    }
+    
+    truncated := false
+    
+    if self.maxLines > 0 {
+        lines := strings.SplitAfter(output, "\n")
+        
+        // a trailing newline doesn't start another line
+        if len(lines) > 0 && lines[len(lines) - 1] == "" {
+            lines = lines[:len(lines) - 1]
+        }
+        
+        if len(lines) > self.maxLines {
+            output = strings.TrimSuffix(strings.Join(lines[:self.maxLines], ""), "\n")
+            truncated = true
+        }
+    }
+    
+    if self.maxBytes > 0 {
+        limit := self.maxBytes
+        if truncated {
+            limit -= len(truncationMarker)
+        }
+        
+        if len(output) > limit {
+            output = truncateUTF8(output, self.maxBytes - len(truncationMarker))
+            truncated = true
+        }
+    }
+    
+    if truncated {
+        output += truncationMarker
+    }
+    
+    return output
+}
+
+// removes control characters other than newlines and tabs, and replaces
+// invalid UTF-8, which protobuf strings can't carry
+func stripControlChars(s string) string {
+    var buf bytes.Buffer
+    
+    // ranging over a string yields RuneError for each invalid byte
+    for _, r := range s {
+        switch {
+            case r == '\n' || r == '\t':
+                buf.WriteRune(r)
+            
+            case r == '\r':
+                // CRLF line endings become LF
+            
+            case unicode.IsControl(r):
+            
+            default:
+                buf.WriteRune(r)
+        }
+    }
+    
+    return buf.String()
+}
+
+// the longest prefix of s no longer than max bytes that doesn't split a
+// character
+func truncateUTF8(s string, max int) string {
+    if len(s) <= max {
+        return s
+    }
+    
+    for max > 0 && ! utf8.RuneStart(s[max]) {
+        max -= 1
+    }
+    
+    return s[:max]
+}
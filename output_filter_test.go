@@ -0,0 +1,61 @@
+package main
+
+import (
+    "strings"
+)
+
+var _ = Describe("OutputFilter", func() {
+    It("passes ordinary output through", func() {
+        filter, err := NewOutputFilter(0, 0, nil)
+        Expect(err).To(BeNil())
+        
+        Expect(filter.Filter("HTTP GET http://localhost/: 200 OK\n")).To(Equal("HTTP GET http://localhost/: 200 OK\n"))
+    })
+    
+    It("strips control characters and invalid UTF-8", func() {
+        filter, _ := NewOutputFilter(0, 0, nil)
+        
+        Expect(filter.Filter("\x1b[31mfailed\x1b[0m\r\n\tdetails\x00\xff")).To(Equal("[31mfailed[0m\n\tdetails�"))
+    })
+    
+    It("redacts secrets", func() {
+        filter, err := NewOutputFilter(0, 0, []string{ `password=\S+`, `token: \w+` })
+        Expect(err).To(BeNil())
+        
+        Expect(filter.Filter("login with password=hunter2 failed; token: abc123")).To(Equal("login with [REDACTED] failed; [REDACTED]"))
+    })
+    
+    It("rejects an invalid redaction pattern", func() {
+        _, err := NewOutputFilter(0, 0, []string{ `(unclosed` })
+        Expect(err).NotTo(BeNil())
+    })
+    
+    It("truncates to a number of lines", func() {
+        filter, _ := NewOutputFilter(0, 2, nil)
+        
+        Expect(filter.Filter("one\ntwo\n")).To(Equal("one\ntwo\n"))
+        Expect(filter.Filter("one\ntwo\nthree\n")).To(Equal("one\ntwo" + truncationMarker))
+    })
+    
+    It("truncates to a number of bytes, including the marker", func() {
+        filter, _ := NewOutputFilter(32, 0, nil)
+        
+        short := strings.Repeat("a", 32)
+        Expect(filter.Filter(short)).To(Equal(short))
+        
+        truncated := filter.Filter(strings.Repeat("a", 1000))
+        Expect(truncated).To(HaveLen(32))
+        Expect(truncated).To(Equal(strings.Repeat("a", 32 - len(truncationMarker)) + truncationMarker))
+    })
+    
+    It("doesn't split a character when truncating", func() {
+        filter, _ := NewOutputFilter(len(truncationMarker) + 3, 0, nil)
+        
+        Expect(filter.Filter("aéééééééé")).To(Equal("aé" + truncationMarker))
+    })
+    
+    It("rejects a byte limit too small for the marker", func() {
+        _, err := NewOutputFilter(len(truncationMarker), 0, nil)
+        Expect(err).NotTo(BeNil())
+    })
+})
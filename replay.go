@@ -0,0 +1,247 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "time"
+    "bytes"
+    "io/ioutil"
+    "encoding/json"
+    
+    log "github.com/Sirupsen/logrus"
+    
+    "github.com/armon/consul-api"
+    "github.com/amir/raidman"
+)
+
+// ReplayCommand runs a recorded snapshot of Consul's health checks through the
+// same pipeline as live results, for seeing what events a given set of checks
+// and options produces.
+type ReplayCommand struct {
+    opts *Options
+    
+    Node       string `long:"node"       description:"reporting node for the events; defaults to the snapshot's, or this host's name"`
+    Datacenter string `long:"datacenter" description:"datacenter for the events; defaults to the snapshot's"`
+    Send       bool   `long:"send"       description:"send the events to Riemann instead of printing them"`
+}
+
+// a recorded snapshot.  the file may also be just the list of checks, as
+// returned by /v1/health/state/any, in which case services have no tags.
+type healthSnapshot struct {
+    Node       string
+    Datacenter string
+    
+    // as returned by /v1/health/state/any
+    Checks     []*consulHealthCheck
+    
+    // each service's entries, as returned by /v1/catalog/service/<name>
+    Services   map[string][]*consulapi.CatalogService
+    
+    // each node's metadata
+    Meta       map[string]map[string]string `json:"NodeMeta"`
+    
+    // each service's attributes, as they would be read from --metadata-prefix
+    Metadata   map[string]map[string]string
+}
+
+// marks every event as replayed, so a replay sent to a live Riemann can be
+// told apart from the leader's events; they carry no real fencing token
+type replayedClient struct {
+    client RiemannClient
+}
+
+func (self *replayedClient) Send(evt *raidman.Event) error {
+    attributes := make(map[string]string, len(evt.Attributes) + 1)
+    for key, value := range evt.Attributes {
+        attributes[key] = value
+    }
+    
+    attributes["replayed"] = "true"
+    evt.Attributes = attributes
+    
+    return self.client.Send(evt)
+}
+
+func (self *replayedClient) Close() {
+    self.client.Close()
+}
+
+func loadHealthSnapshot(path string) (*healthSnapshot, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    
+    snapshot := &healthSnapshot{}
+    
+    if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+        err = json.Unmarshal(data, &snapshot.Checks)
+    } else {
+        err = json.Unmarshal(data, snapshot)
+    }
+    
+    if err != nil {
+        return nil, fmt.Errorf("invalid snapshot %s: %v", path, err)
+    }
+    
+    return snapshot, nil
+}
+
+// the snapshot stands in for Consul's health and catalog endpoints.  it never
+// changes, so there's no blocking.
+func (self *healthSnapshot) State(state string, q *consulapi.QueryOptions) ([]*consulapi.HealthCheck, *consulapi.QueryMeta, error) {
+    healthChecks := make([]*consulapi.HealthCheck, 0, len(self.Checks))
+    
+    for _, check := range self.Checks {
+        if state == "any" || check.Status == state {
+            healthCheck := check.HealthCheck
+            healthChecks = append(healthChecks, &healthCheck)
+        }
+    }
+    
+    return healthChecks, &consulapi.QueryMeta{ LastIndex: 1 }, nil
+}
+
+func (self *healthSnapshot) DetailedState(state string, q *consulapi.QueryOptions) ([]*consulHealthCheck, *consulapi.QueryMeta, error) {
+    checks := make([]*consulHealthCheck, 0, len(self.Checks))
+    
+    for _, check := range self.Checks {
+        if state == "any" || check.Status == state {
+            checks = append(checks, check)
+        }
+    }
+    
+    return checks, &consulapi.QueryMeta{ LastIndex: 1 }, nil
+}
+
+func (self *healthSnapshot) Service(service, tag string, q *consulapi.QueryOptions) ([]*consulapi.CatalogService, *consulapi.QueryMeta, error) {
+    return self.Services[service], &consulapi.QueryMeta{ LastIndex: 1 }, nil
+}
+
+func (self *healthSnapshot) NodeMeta(q *consulapi.QueryOptions) (map[string]map[string]string, *consulapi.QueryMeta, error) {
+    return self.Meta, &consulapi.QueryMeta{ LastIndex: 1 }, nil
+}
+
+// the health results for the snapshot, as the health checker would produce
+// them
+func replayHealthResults(snapshot *healthSnapshot, updateInterval time.Duration) ([]HealthCheck, error) {
+    done := make(chan interface{})
+    defer close(done)
+    
+    healthResults, more := <-NewHealthChecker(snapshot, snapshot, updateInterval).WatchHealthResults(done)
+    if ! more {
+        return nil, fmt.Errorf("unable to process snapshot")
+    }
+    
+    return healthResults, nil
+}
+
+func (self *ReplayCommand) Execute(args []string) error {
+    if len(args) != 1 {
+        return fmt.Errorf("usage: replay [OPTIONS] <snapshot file>")
+    }
+    
+    if self.opts.Debug {
+        log.SetLevel(log.DebugLevel)
+    }
+    
+    snapshot, err := loadHealthSnapshot(args[0])
+    if err != nil {
+        return err
+    }
+    
+    updateInterval, err := time.ParseDuration(self.opts.UpdateInterval)
+    if err != nil {
+        return fmt.Errorf("invalid update interval %s", self.opts.UpdateInterval)
+    }
+    
+    eventTTL, err := parseTTL(self.opts.EventTTL, updateInterval)
+    if err != nil {
+        return fmt.Errorf("invalid event TTL: %v", err)
+    }
+    
+    nodeName := self.Node
+    if nodeName == "" {
+        nodeName = snapshot.Node
+    }
+    
+    if nodeName == "" {
+        nodeName, _ = os.Hostname()
+    }
+    
+    dc := self.Datacenter
+    if dc == "" {
+        dc = snapshot.Datacenter
+    }
+    
+    var dialRiemann RiemannDialer
+    
+    if self.Send {
+        if self.opts.RiemannHost == "" {
+            return fmt.Errorf("sending events requires --riemann-host")
+        }
+        
+        dialRiemann, err = newRiemannDialer(self.opts)
+        if err != nil {
+            return err
+        }
+    } else {
+        printer := NewEventPrinter(os.Stdout)
+        dialRiemann = func() (RiemannClient, error) {
+            return printer, nil
+        }
+    }
+    
+    sink, err := newReplaySink(self.opts, snapshot, dialRiemann, updateInterval, nodeName, dc, eventTTL)
+    if err != nil {
+        return err
+    }
+    
+    healthResults, err := replayHealthResults(snapshot, updateInterval)
+    if err != nil {
+        return err
+    }
+    
+    if err := sink.Open(); err != nil {
+        return err
+    }
+    
+    defer sink.Close()
+    
+    return sink.Send(healthResults)
+}
+
+// the riemann sink for a replay, with the snapshot's metadata
+func newReplaySink(
+    opts           *Options,
+    snapshot       *healthSnapshot,
+    dialRiemann    RiemannDialer,
+    updateInterval time.Duration,
+    nodeName       string,
+    dc             string,
+    eventTTL       time.Duration,
+) (*RiemannSink, error) {
+    var metadata *ServiceMetadata
+    if len(snapshot.Metadata) > 0 {
+        metadata = NewServiceMetadata(nil, opts.MetadataPrefix, updateInterval)
+        metadata.attributes = snapshot.Metadata
+    }
+    
+    var nodeMetadata *NodeMetadata
+    if len(opts.NodeMetaAttributes) > 0 || len(opts.NodeMetaTags) > 0 {
+        nodeMetadata = NewNodeMetadata(snapshot, updateInterval)
+        nodeMetadata.Refresh(0)
+    }
+    
+    dialReplayed := func() (RiemannClient, error) {
+        client, err := dialRiemann()
+        if err != nil {
+            return nil, err
+        }
+        
+        return &replayedClient{ client: client }, nil
+    }
+    
+    // there's no lock, so no fencing token, and nothing is persisted
+    return newRiemannSink(opts, dialReplayed, updateInterval, nodeName, dc, eventTTL, func() uint64 { return 0 }, nil, metadata, nodeMetadata)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+    "os"
+    "time"
+    "bytes"
+    "strings"
+    "io/ioutil"
+    "encoding/json"
+
+    "github.com/amir/raidman"
+)
+
+var _ = Describe("replay", func() {
+    var tmpDir string
+    
+    writeSnapshot := func(content string) string {
+        path := tmpDir + "/snapshot.json"
+        Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(BeNil())
+        
+        return path
+    }
+    
+    BeforeEach(func() {
+        var err error
+        
+        tmpDir, err = ioutil.TempDir("", "replay")
+        Expect(err).To(BeNil())
+    })
+    
+    AfterEach(func() {
+        os.RemoveAll(tmpDir)
+    })
+    
+    It("loads a bare list of checks", func() {
+        snapshot, err := loadHealthSnapshot(writeSnapshot(`[
+            { "Node": "node1", "CheckID": "serfHealth", "Status": "passing" }
+        ]`))
+        
+        Expect(err).To(BeNil())
+        Expect(snapshot.Checks).To(HaveLen(1))
+        Expect(snapshot.Checks[0].Node).To(Equal("node1"))
+    })
+    
+    It("rejects a malformed snapshot", func() {
+        _, err := loadHealthSnapshot(writeSnapshot(`{ "Checks": `))
+        Expect(err).NotTo(BeNil())
+    })
+    
+    It("produces the same health results as the health checker", func() {
+        snapshot, err := loadHealthSnapshot(writeSnapshot(`{
+            "Node": "reporter",
+            "Datacenter": "dc1",
+            "Checks": [
+                { "Node": "node1", "CheckID": "serfHealth", "Status": "passing" },
+                {
+                    "Node": "node1", "CheckID": "service:web", "Status": "critical",
+                    "ServiceID": "web", "ServiceName": "web", "Output": "connection refused",
+                    "Type": "http", "Definition": { "HTTP": "http://localhost/", "Interval": "10s" }
+                }
+            ],
+            "Services": {
+                "web": [ { "Node": "node1", "ServiceID": "web", "ServiceName": "web", "ServiceTags": [ "prod" ] } ]
+            },
+            "NodeMeta": { "node1": { "rack": "r1" } }
+        }`))
+        Expect(err).To(BeNil())
+        
+        healthResults, err := replayHealthResults(snapshot, time.Minute)
+        Expect(err).To(BeNil())
+        Expect(healthResults).To(HaveLen(2))
+        
+        web := healthResults[1]
+        Expect(web.CheckID).To(Equal("service:web"))
+        Expect(web.Tags).To(Equal([]string{ "prod" }))
+        Expect(web.CheckType).To(Equal("http"))
+        Expect(web.Target).To(Equal("http://localhost/"))
+        Expect(web.Interval).To(Equal("10s"))
+        
+        meta, _, _ := snapshot.NodeMeta(nil)
+        Expect(meta["node1"]).To(HaveKeyWithValue("rack", "r1"))
+    })
+    
+    It("prints the resulting events", func() {
+        snapshot, _ := loadHealthSnapshot(writeSnapshot(`[
+            { "Node": "node1", "CheckID": "serfHealth", "Status": "passing" },
+            { "Node": "node2", "CheckID": "serfHealth", "Status": "critical", "Output": "Agent not live" }
+        ]`))
+        
+        healthResults, err := replayHealthResults(snapshot, time.Minute)
+        Expect(err).To(BeNil())
+        
+        var buf bytes.Buffer
+        printer := NewEventPrinter(&buf)
+        
+        opts := &Options{ NodeDownMode: NodeDownSend, FlapWindow: "0" }
+        sink, err := newRiemannSink(
+            opts,
+            func() (RiemannClient, error) { return printer, nil },
+            time.Minute,
+            "reporter",
+            "dc1",
+            3 * time.Minute,
+            func() uint64 { return 0 },
+            nil,
+            nil,
+            nil,
+        )
+        Expect(err).To(BeNil())
+        
+        Expect(sink.Open()).To(BeNil())
+        Expect(sink.Send(healthResults)).To(BeNil())
+        
+        lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+        Expect(lines).To(HaveLen(2))
+        
+        var evt raidman.Event
+        Expect(json.Unmarshal([]byte(lines[1]), &evt)).To(BeNil())
+        Expect(evt.Host).To(Equal("node2"))
+        Expect(evt.State).To(Equal("critical"))
+        Expect(evt.Description).To(Equal("Agent not live"))
+        Expect(evt.Attributes).To(HaveKeyWithValue("reporting_node", "reporter"))
+    })
+    
+    It("applies the snapshot's service metadata and marks events as replayed", func() {
+        snapshot, err := loadHealthSnapshot(writeSnapshot(`{
+            "Checks": [
+                {
+                    "Node": "node1", "CheckID": "service:web", "Status": "passing",
+                    "ServiceID": "web", "ServiceName": "web"
+                }
+            ],
+            "Services": {
+                "web": [ { "Node": "node1", "ServiceID": "web", "ServiceName": "web" } ]
+            },
+            "Metadata": { "web": { "team": "payments" } }
+        }`))
+        Expect(err).To(BeNil())
+        
+        healthResults, err := replayHealthResults(snapshot, time.Minute)
+        Expect(err).To(BeNil())
+        
+        var buf bytes.Buffer
+        printer := NewEventPrinter(&buf)
+        
+        opts := &Options{ NodeDownMode: NodeDownSend, FlapWindow: "0" }
+        sink, err := newReplaySink(
+            opts,
+            snapshot,
+            func() (RiemannClient, error) { return printer, nil },
+            time.Minute,
+            "reporter",
+            "dc1",
+            3 * time.Minute,
+        )
+        Expect(err).To(BeNil())
+        
+        Expect(sink.Open()).To(BeNil())
+        Expect(sink.Send(healthResults)).To(BeNil())
+        
+        var evt raidman.Event
+        Expect(json.Unmarshal(buf.Bytes(), &evt)).To(BeNil())
+        Expect(evt.Attributes).To(HaveKeyWithValue("team", "payments"))
+        Expect(evt.Attributes).To(HaveKeyWithValue("replayed", "true"))
+        Expect(evt.Attributes).To(HaveKeyWithValue("fencing_token", "0"))
+    })
+})
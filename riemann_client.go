@@ -0,0 +1,241 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    
+    log "github.com/Sirupsen/logrus"
+    "github.com/amir/raidman"
+)
+
+// values for --proto
+const (
+    // UDP, except for events too large for a datagram
+    RiemannProtoUDP  = "udp"
+    
+    // everything over TCP
+    RiemannProtoTCP  = "tcp"
+    
+    // TCP if Riemann accepts the connection, otherwise as for udp
+    RiemannProtoAuto = "auto"
+)
+
+// AdaptiveRiemannClient sends events over UDP or TCP, depending on the
+// protocol it was asked for, what Riemann will accept, and the size of each
+// event.  UDP is cheap but drops anything that doesn't fit in a datagram, and
+// there's no telling whether Riemann got the rest; TCP sends wait for Riemann
+// to acknowledge the event.
+type AdaptiveRiemannClient struct {
+    // a udpFallbackClient, or a tcpRiemannClient for everything
+    client RiemannClient
+}
+
+// returns a dialer for clients using the given protocol, one of the
+// RiemannProto* constants.  dialUDP and dialTCP open plain connections.
+func NewAdaptiveRiemannDialer(proto string, dialUDP, dialTCP RiemannDialer, maxSize int, reliable bool) (RiemannDialer, error) {
+    switch proto {
+        case RiemannProtoUDP, RiemannProtoTCP, RiemannProtoAuto:
+        
+        default:
+            return nil, fmt.Errorf("invalid protocol %s; must be %s, %s or %s", proto, RiemannProtoUDP, RiemannProtoTCP, RiemannProtoAuto)
+    }
+    
+    if maxSize <= 0 {
+        return nil, fmt.Errorf("UDP size limit must be positive")
+    }
+    
+    // acknowledgements only come over TCP
+    if reliable {
+        proto = RiemannProtoTCP
+    }
+    
+    return func() (RiemannClient, error) {
+        tcp := newTCPRiemannClient(dialTCP, reliable)
+        
+        if proto != RiemannProtoUDP {
+            err := tcp.connect()
+            
+            if err == nil {
+                return &AdaptiveRiemannClient{ client: tcp }, nil
+            }
+            
+            if proto == RiemannProtoTCP {
+                return nil, err
+            }
+            
+            log.Warnf("unable to connect to Riemann via TCP, using UDP: %v", err)
+        }
+        
+        udp, err := dialUDP()
+        if err != nil {
+            return nil, err
+        }
+        
+        return &AdaptiveRiemannClient{ client: newUDPFallbackClient(udp, tcp, maxSize) }, nil
+    }, nil
+}
+
+func (self *AdaptiveRiemannClient) Send(evt *raidman.Event) error {
+    return self.client.Send(evt)
+}
+
+func (self *AdaptiveRiemannClient) Close() {
+    self.client.Close()
+}
+
+// sends events over a TCP connection, waiting for Riemann to acknowledge each
+// one.  the connection is opened when first needed, and again after a failure.
+type tcpRiemannClient struct {
+    sync.Mutex
+    
+    dial RiemannDialer
+    conn RiemannClient
+    
+    // every event must be acknowledged, so failures are logged
+    reliable bool
+}
+
+func newTCPRiemannClient(dial RiemannDialer, reliable bool) *tcpRiemannClient {
+    return &tcpRiemannClient{
+        dial:     dial,
+        reliable: reliable,
+    }
+}
+
+// opens the connection if it isn't already; must be called with the lock held,
+// or before the client is shared
+func (self *tcpRiemannClient) connect() error {
+    if self.conn != nil {
+        return nil
+    }
+    
+    log.Debug("connecting to Riemann via TCP")
+    
+    conn, err := self.dial()
+    if err != nil {
+        return fmt.Errorf("unable to connect to Riemann via TCP: %v", err)
+    }
+    
+    self.conn = conn
+    
+    return nil
+}
+
+func (self *tcpRiemannClient) Send(evt *raidman.Event) error {
+    self.Lock()
+    defer self.Unlock()
+    
+    err := self.connect()
+    
+    if err == nil {
+        // raidman waits for Riemann's acknowledgement
+        err = self.conn.Send(evt)
+        
+        if err != nil {
+            // reconnect next time
+            self.conn.Close()
+            self.conn = nil
+        }
+    }
+    
+    if err != nil {
+        metricUnacknowledgedEvents.Inc()
+        
+        if self.reliable {
+            log.Errorf("event for %s on %s not acknowledged: %v", evt.Service, evt.Host, err)
+        }
+        
+        return err
+    }
+    
+    metricEventsSent.Inc()
+    
+    return nil
+}
+
+func (self *tcpRiemannClient) Close() {
+    self.Lock()
+    defer self.Unlock()
+    
+    if self.conn != nil {
+        self.conn.Close()
+        self.conn = nil
+    }
+}
+
+// sends events over UDP unless they're too big for a datagram, in which case
+// they go over TCP.  Riemann doesn't acknowledge UDP events, so they're only
+// counted as attempted.
+type udpFallbackClient struct {
+    udp RiemannClient
+    tcp *tcpRiemannClient
+    
+    // largest message, in bytes, sent over UDP
+    maxSize int
+}
+
+func newUDPFallbackClient(udp RiemannClient, tcp *tcpRiemannClient, maxSize int) *udpFallbackClient {
+    return &udpFallbackClient{
+        udp:     udp,
+        tcp:     tcp,
+        maxSize: maxSize,
+    }
+}
+
+func (self *udpFallbackClient) Send(evt *raidman.Event) error {
+    if estimateMessageSize(evt) > self.maxSize {
+        log.Debugf("event for %s on %s too large for UDP; sending via TCP", evt.Service, evt.Host)
+        metricOversizedEvents.Inc()
+        
+        return self.tcp.Send(evt)
+    }
+    
+    if err := self.udp.Send(evt); err != nil {
+        return err
+    }
+    
+    metricUDPEventsAttempted.Inc()
+    
+    return nil
+}
+
+func (self *udpFallbackClient) Close() {
+    self.udp.Close()
+    self.tcp.Close()
+}
+
+// an upper bound on the size of the protobuf message raidman sends for a
+// single event.  numeric fields are counted at their largest encoding.
+func estimateMessageSize(evt *raidman.Event) int {
+    size := 0
+    
+    // time, ttl and metric
+    size += 11 + 5 + 11
+    
+    for _, s := range []string{ evt.State, evt.Service, evt.Host, evt.Description } {
+        size += protoFieldSize(len(s))
+    }
+    
+    for _, tag := range evt.Tags {
+        size += protoFieldSize(len(tag))
+    }
+    
+    for key, value := range evt.Attributes {
+        size += protoFieldSize(protoFieldSize(len(key)) + protoFieldSize(len(value)))
+    }
+    
+    // the event is itself a field of the message
+    return protoFieldSize(size)
+}
+
+// a length-delimited protobuf field: a one-byte key, the length as a varint,
+// and the contents
+func protoFieldSize(length int) int {
+    size := 1 + 1
+    
+    for v := length; v >= 0x80; v >>= 7 {
+        size += 1
+    }
+    
+    return size + length
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/amir/raidman"
+)
+
+var _ = Describe("AdaptiveRiemannClient", func() {
+    var udp, tcp *recordingRiemann
+    var udpDials, tcpDials int
+    var tcpDialErr error
+    
+    dialer := func(proto string, reliable bool) RiemannDialer {
+        dial, err := NewAdaptiveRiemannDialer(
+            proto,
+            func() (RiemannClient, error) {
+                udpDials += 1
+                return udp, nil
+            },
+            func() (RiemannClient, error) {
+                tcpDials += 1
+                
+                if tcpDialErr != nil {
+                    return nil, tcpDialErr
+                }
+                
+                return tcp, nil
+            },
+            1024,
+            reliable,
+        )
+        
+        Expect(err).To(BeNil())
+        return dial
+    }
+    
+    BeforeEach(func() {
+        udp = &recordingRiemann{}
+        tcp = &recordingRiemann{}
+        udpDials = 0
+        tcpDials = 0
+        tcpDialErr = nil
+    })
+    
+    small := &raidman.Event{ Host: "node1", Service: "web", State: "ok" }
+    large := &raidman.Event{ Host: "node1", Service: "web", State: "ok", Description: strings.Repeat("x", 2048) }
+    
+    It("rejects an unknown protocol", func() {
+        _, err := NewAdaptiveRiemannDialer("carrier-pigeon", nil, nil, 1024, false)
+        Expect(err).NotTo(BeNil())
+    })
+    
+    Describe("via udp", func() {
+        It("sends small events over UDP and oversized ones over TCP", func() {
+            client, err := dialer("udp", false)()
+            Expect(err).To(BeNil())
+            
+            Expect(client.Send(small)).To(BeNil())
+            Expect(client.Send(large)).To(BeNil())
+            
+            Expect(udp.events).To(HaveLen(1))
+            Expect(tcp.events).To(HaveLen(1))
+        })
+    })
+    
+    Describe("via tcp", func() {
+        It("sends everything over TCP", func() {
+            client, err := dialer("tcp", false)()
+            Expect(err).To(BeNil())
+            
+            Expect(client.Send(small)).To(BeNil())
+            Expect(client.Send(large)).To(BeNil())
+            
+            Expect(tcp.events).To(HaveLen(2))
+            Expect(udpDials).To(Equal(0))
+        })
+        
+        It("fails if Riemann doesn't accept the connection", func() {
+            tcpDialErr = fmt.Errorf("connection refused")
+            
+            _, err := dialer("tcp", false)()
+            Expect(err).NotTo(BeNil())
+        })
+    })
+    
+    Describe("via auto", func() {
+        It("prefers TCP", func() {
+            client, err := dialer("auto", false)()
+            Expect(err).To(BeNil())
+            
+            Expect(client.Send(small)).To(BeNil())
+            
+            Expect(tcp.events).To(HaveLen(1))
+            Expect(udpDials).To(Equal(0))
+        })
+        
+        It("falls back to UDP if TCP is unavailable", func() {
+            tcpDialErr = fmt.Errorf("connection refused")
+            
+            client, err := dialer("auto", false)()
+            Expect(err).To(BeNil())
+            
+            Expect(client.Send(small)).To(BeNil())
+            Expect(udp.events).To(HaveLen(1))
+        })
+    })
+    
+    Describe("in reliable mode", func() {
+        It("sends everything over TCP regardless of the protocol", func() {
+            client, err := dialer("udp", true)()
+            Expect(err).To(BeNil())
+            
+            Expect(client.Send(small)).To(BeNil())
+            
+            Expect(tcp.events).To(HaveLen(1))
+            Expect(udpDials).To(Equal(0))
+        })
+        
+        It("counts events that aren't acknowledged", func() {
+            client, _ := dialer("udp", true)()
+            tcp.sendErr = fmt.Errorf("no ack")
+            
+            before := metricUnacknowledgedEvents.Value()
+            sent := metricEventsSent.Value()
+            
+            Expect(client.Send(small)).NotTo(BeNil())
+            Expect(metricUnacknowledgedEvents.Value()).To(Equal(before + 1))
+            Expect(metricEventsSent.Value()).To(Equal(sent))
+        })
+    })
+})
+
+var _ = Describe("udpFallbackClient", func() {
+    var udp, tcp *recordingRiemann
+    var tcpDials int
+    var dialErr error
+    var client *udpFallbackClient
+    
+    BeforeEach(func() {
+        udp = &recordingRiemann{}
+        tcp = &recordingRiemann{}
+        tcpDials = 0
+        dialErr = nil
+        
+        client = newUDPFallbackClient(udp, newTCPRiemannClient(func() (RiemannClient, error) {
+            tcpDials += 1
+            
+            if dialErr != nil {
+                return nil, dialErr
+            }
+            
+            return tcp, nil
+        }, false), 1024)
+    })
+    
+    small := &raidman.Event{ Host: "node1", Service: "web", State: "ok" }
+    large := &raidman.Event{ Host: "node1", Service: "web", State: "ok", Description: strings.Repeat("x", 2048) }
+    
+    It("sends small events over UDP", func() {
+        Expect(client.Send(small)).To(BeNil())
+        
+        Expect(udp.events).To(HaveLen(1))
+        Expect(tcpDials).To(Equal(0))
+    })
+    
+    It("counts UDP events as attempted, not sent", func() {
+        attempted := metricUDPEventsAttempted.Value()
+        sent := metricEventsSent.Value()
+        
+        Expect(client.Send(small)).To(BeNil())
+        
+        Expect(metricUDPEventsAttempted.Value()).To(Equal(attempted + 1))
+        Expect(metricEventsSent.Value()).To(Equal(sent))
+    })
+    
+    It("sends oversized events over a single TCP connection", func() {
+        sent := metricEventsSent.Value()
+        
+        Expect(client.Send(large)).To(BeNil())
+        Expect(client.Send(large)).To(BeNil())
+        
+        Expect(udp.events).To(BeEmpty())
+        Expect(tcp.events).To(HaveLen(2))
+        Expect(tcpDials).To(Equal(1))
+        Expect(metricEventsSent.Value()).To(Equal(sent + 2))
+    })
+    
+    It("reconnects via TCP after a failure", func() {
+        tcp.sendErr = fmt.Errorf("connection reset")
+        Expect(client.Send(large)).NotTo(BeNil())
+        Expect(tcp.closed).To(Equal(true))
+        
+        tcp.sendErr = nil
+        Expect(client.Send(large)).To(BeNil())
+        Expect(tcpDials).To(Equal(2))
+    })
+    
+    It("reports a failure to connect via TCP", func() {
+        dialErr = fmt.Errorf("connection refused")
+        
+        Expect(client.Send(large)).NotTo(BeNil())
+        Expect(client.Send(small)).To(BeNil())
+    })
+    
+    It("closes both connections", func() {
+        client.Send(large)
+        client.Close()
+        
+        Expect(udp.closed).To(Equal(true))
+        Expect(tcp.closed).To(Equal(true))
+    })
+    
+    It("overestimates the size of an event", func() {
+        evt := &raidman.Event{
+            Host:        "node1",
+            Service:     "web",
+            Description: strings.Repeat("x", 300),
+            Tags:        []string{ "consul" },
+            Attributes:  map[string]string{ "datacenter": "dc1" },
+        }
+        
+        // 300 bytes of description plus at least a key and two length bytes
+        Expect(estimateMessageSize(evt)).To(BeNumerically(">", 300 + 3 + 5 + 2 + 6 + 2 + 10 + 3))
+        Expect(estimateMessageSize(evt)).To(BeNumerically("<", 400))
+    })
+})
@@ -0,0 +1,585 @@
+package main
+
+import (
+    "fmt"
+    "time"
+    "strings"
+    "strconv"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/amir/raidman"
+)
+
+// RiemannSink sends one event per health check to Riemann.
+type RiemannSink struct {
+    dial           RiemannDialer
+    riemann        RiemannClient
+    updateInterval time.Duration
+    nodeName       string
+    dc             string
+    fencingToken   func() uint64
+    
+    // TTL of each event; services may override it with a riemann-ttl tag
+    eventTTL time.Duration
+    
+    // service name format for per-service rollups; disabled if empty
+    serviceRollupFormat string
+    
+    // service name for per-node rollups; disabled if empty
+    nodeRollupName string
+    
+    // one of the NodeDown* constants
+    nodeDownMode string
+    
+    // state for checks of nodes and services in maintenance mode; if empty,
+    // they're sent as-is
+    maintenanceState string
+    
+    // history of each check's status, for flap detection and time in state
+    tracker *CheckTracker
+    
+    // state of the final event sent for checks that disappear from Consul;
+    // none are sent if empty
+    expiredState string
+    
+    // per-service attributes from KV; may be nil
+    metadata *ServiceMetadata
+    
+    // node metadata, and which of its keys become attributes and tags; may be
+    // nil
+    nodeMetadata  *NodeMetadata
+    nodeMetaAttrs []string
+    nodeMetaTags  []string
+    
+    // where the tracker's state is kept between leaders; may be nil
+    checkStates *CheckStateStore
+    restored    bool
+    
+    // cleans up check output for event descriptions; may be nil
+    outputFilter *OutputFilter
+}
+
+func NewRiemannSink(dial RiemannDialer, updateInterval time.Duration, nodeName, dc string, fencingToken func() uint64) *RiemannSink {
+    return &RiemannSink{
+        dial:           dial,
+        updateInterval: updateInterval,
+        nodeName:       nodeName,
+        dc:             dc,
+        fencingToken:   fencingToken,
+        eventTTL:       updateInterval * 3,
+        nodeDownMode:   NodeDownSend,
+        tracker:        NewCheckTracker(0, 0),
+    }
+}
+
+// sets the TTL of each event; three times the update interval by default
+func (self *RiemannSink) UseEventTTL(ttl time.Duration) error {
+    if ttl <= self.updateInterval {
+        return fmt.Errorf("event TTL must be greater than update interval")
+    }
+    
+    self.eventTTL = ttl
+    
+    return nil
+}
+
+// also send rollups of each service's instances by status.  the format's %s is
+// replaced with the service name.
+func (self *RiemannSink) UseServiceRollups(format string) error {
+    if strings.Count(format, "%s") != 1 {
+        return fmt.Errorf("rollup format %q must contain %%s exactly once", format)
+    }
+    
+    self.serviceRollupFormat = format
+    
+    return nil
+}
+
+// also send a summary of each node's checks, with the node as the host
+func (self *RiemannSink) UseNodeRollups(name string) {
+    self.nodeRollupName = name
+}
+
+// sets what's done with the checks of a node whose serfHealth check is
+// critical; see the NodeDown* constants
+func (self *RiemannSink) UseNodeDownMode(mode string) error {
+    switch mode {
+        case NodeDownSend, NodeDownTag, NodeDownCollapse:
+            self.nodeDownMode = mode
+            return nil
+    }
+    
+    return fmt.Errorf("invalid node-down mode %s; must be %s, %s or %s", mode, NodeDownSend, NodeDownTag, NodeDownCollapse)
+}
+
+// sends the checks of nodes and services in maintenance mode with the given
+// state instead of their own
+func (self *RiemannSink) UseMaintenanceState(state string) {
+    self.maintenanceState = state
+}
+
+// sends checks that change status at least threshold times within the window
+// with the "flapping" state and the number of changes as the metric, rather
+// than forwarding every change
+func (self *RiemannSink) UseFlapDetection(window time.Duration, threshold int) error {
+    if window < self.updateInterval {
+        return fmt.Errorf("flap window %s must be at least the update interval, %s", window, self.updateInterval)
+    }
+    
+    if threshold < 2 {
+        return fmt.Errorf("flap threshold must be at least 2")
+    }
+    
+    self.tracker = NewCheckTracker(window, threshold)
+    
+    return nil
+}
+
+// persists when each check entered its current status, so the time in state
+// carries over to the next leader
+func (self *RiemannSink) UseCheckStateStore(store *CheckStateStore) {
+    self.checkStates = store
+}
+
+// sends a final event with the given state, tagged "deregistered", for each
+// check that disappears from Consul, rather than leaving its last event to
+// linger in Riemann's index until it expires
+func (self *RiemannSink) UseExpiredState(state string) {
+    self.expiredState = state
+}
+
+// adds the service's metadata from KV to the attributes of its events
+func (self *RiemannSink) UseServiceMetadata(metadata *ServiceMetadata) {
+    self.metadata = metadata
+}
+
+// adds the given keys of each node's metadata to the events for its checks,
+// as attributes or as <key>:<value> tags
+func (self *RiemannSink) UseNodeMetadata(metadata *NodeMetadata, attributeKeys, tagKeys []string) {
+    self.nodeMetadata = metadata
+    self.nodeMetaAttrs = attributeKeys
+    self.nodeMetaTags = tagKeys
+}
+
+// truncates, sanitizes and redacts check output before it's sent
+func (self *RiemannSink) UseOutputFilter(filter *OutputFilter) {
+    self.outputFilter = filter
+}
+
+func (self *RiemannSink) Name() string {
+    return "riemann"
+}
+
+func (self *RiemannSink) Open() error {
+    if self.checkStates != nil && ! self.restored {
+        states, err := self.checkStates.Load()
+        
+        if err != nil {
+            // not fatal; times in state restart from now
+            log.Warnf("unable to load check states: %v", err)
+        } else {
+            self.tracker.Restore(states)
+        }
+        
+        self.restored = true
+    }
+    
+    return self.connect()
+}
+
+func (self *RiemannSink) connect() error {
+    if self.riemann != nil {
+        return nil
+    }
+    
+    riemann, err := self.dial()
+    if err != nil {
+        return err
+    }
+    
+    self.riemann = riemann
+    
+    return nil
+}
+
+func (self *RiemannSink) Send(healthResults []HealthCheck) error {
+    // reconnect if the last attempt failed
+    if err := self.connect(); err != nil {
+        return err
+    }
+    
+    healthResults, overrides := self.applyOverrides(healthResults)
+    
+    changed := self.tracker.Update(healthResults, time.Now())
+    
+    for _, healthCheck := range healthResults {
+        override := overrides[nodeCheckKey{ healthCheck.Node, healthCheck.CheckID }]
+        
+        if self.tracker.Label(healthCheck, override.serviceFor(healthCheck), self.ttlFor(override)) {
+            changed = true
+        }
+    }
+    
+    // checks that have been deregistered are only forgotten once their final
+    // events have been sent
+    vanished := self.tracker.Vanished(healthResults)
+    
+    events := self.healthCheckEvents(healthResults, overrides)
+    
+    if self.expiredState != "" {
+        events = append(events, self.expiredEvents(vanished)...)
+    }
+    
+    if self.serviceRollupFormat != "" {
+        events = append(events, self.serviceRollupEvents(healthResults)...)
+    }
+    
+    if self.nodeRollupName != "" {
+        events = append(events, self.nodeRollupEvents(healthResults)...)
+    }
+    
+    err := sendEvents(self.riemann, events)
+    
+    if err != nil {
+        // the connection's probably no good
+        self.disconnect()
+    } else if len(vanished) > 0 {
+        self.tracker.Forget(vanished)
+        changed = true
+    }
+    
+    if changed && self.checkStates != nil {
+        if err := self.checkStates.Save(self.tracker.Snapshot()); err != nil {
+            log.Warnf("unable to save check states: %v", err)
+        }
+    }
+    
+    return err
+}
+
+// we're no longer the leader; whoever is next starts from scratch
+func (self *RiemannSink) Close() {
+    self.disconnect()
+    self.tracker.Reset()
+    self.restored = false
+}
+
+func (self *RiemannSink) disconnect() {
+    if self.riemann != nil {
+        self.riemann.Close()
+        self.riemann = nil
+    }
+}
+
+// parses each check's riemann: tags, and drops the checks of ignored
+// services, which aren't tracked, rolled up or sent at all
+func (self *RiemannSink) applyOverrides(healthResults []HealthCheck) ([]HealthCheck, map[nodeCheckKey]*eventOverrides) {
+    included := make([]HealthCheck, 0, len(healthResults))
+    overrides := make(map[nodeCheckKey]*eventOverrides)
+    
+    for _, healthCheck := range healthResults {
+        override, errs := parseEventOverrides(healthCheck.Tags, self.updateInterval)
+        for _, err := range errs {
+            log.Warnf("%s on %s: %v", healthCheck.ServiceID, healthCheck.Node, err)
+        }
+        
+        if override.Ignore {
+            continue
+        }
+        
+        overrides[nodeCheckKey{ healthCheck.Node, healthCheck.CheckID }] = override
+        included = append(included, healthCheck)
+    }
+    
+    return included, overrides
+}
+
+// the TTL of the events for a check with the given overrides
+func (self *RiemannSink) ttlFor(overrides *eventOverrides) time.Duration {
+    if overrides.TTL > 0 {
+        return overrides.TTL
+    }
+    
+    return self.eventTTL
+}
+
+// one event per health check, with the overrides from applyOverrides
+func (self *RiemannSink) healthCheckEvents(healthResults []HealthCheck, allOverrides map[nodeCheckKey]*eventOverrides) []*raidman.Event {
+    var events []*raidman.Event
+    
+    fencingToken := self.fencingToken()
+    now := time.Now()
+    
+    down := make(map[string]bool)
+    if self.nodeDownMode != NodeDownSend {
+        down = downNodes(healthResults)
+    }
+    
+    maint := findMaintenance(healthResults)
+    
+    // serfHealth events and the checks collapsed into them, by node
+    serfEvents := make(map[string]*raidman.Event)
+    collapsed := make(map[string][]string)
+    
+    for _, healthCheck := range healthResults {
+        // {
+        //   "Name": "Service 'client-youngaustria' check",
+        //   "ServiceName": "client-youngaustria",
+        //   "Node": "web-fwork-gen-028.us-east-1.aws.prod.bsdinternal.com"
+        //   "CheckID": "service:client-youngaustria",
+        //   "ServiceID": "client-youngaustria",
+        //   "Output": "TTL expired",
+        //   "Notes": "",
+        //   "Status": "critical",
+        // },
+
+        // the service's riemann: tags
+        overrides := allOverrides[nodeCheckKey{ healthCheck.Node, healthCheck.CheckID }]
+        
+        // Riemann event TTL: A floating-point time, in seconds, that
+        // this event is considered valid for
+        eventTtl := riemannTTL(self.ttlFor(overrides))
+        
+        // convert Consul status to Riemann state
+        state := map[string]string{
+            "passing":  "ok",
+            "warning":  "warning",
+            "critical": "critical",
+        }[healthCheck.Status]
+        
+        description := healthCheck.Output
+        if self.outputFilter != nil {
+            description = self.outputFilter.Filter(description)
+        }
+        
+        // there may be multiple services with the same name on a given host;
+        // these must have different serviceIds. there are also checks that
+        // aren't associated with a specific service.  service-specific checks
+        // have an id of "service:<serviceId>".
+        evt := &raidman.Event{
+            Ttl:         eventTtl,
+            Time:        time.Now().Unix(),
+            Tags:        append(overrides.Tags, "consul"),
+            Host:        healthCheck.Node,
+            State:       state,
+            Service:     overrides.serviceFor(healthCheck),
+            Description: description,
+            Attributes:  map[string]string{
+                "reporting_node": self.nodeName,
+                "datacenter":     self.dc,
+                "notes":          healthCheck.Notes,
+                // increases with each change of leadership, so Riemann
+                // can drop events from a stale leader
+                "fencing_token":  strconv.FormatUint(fencingToken, 10),
+            },
+        }
+        
+        for key, value := range healthCheck.CheckDetails.attributes() {
+            evt.Attributes[key] = value
+        }
+        
+        // extra attributes from KV and riemann:attr tags, in that order of
+        // precedence, but never replacing our own
+        extra := make(map[string]string)
+        
+        if self.metadata != nil && healthCheck.ServiceName != "" {
+            for key, value := range self.metadata.Attributes(healthCheck.ServiceName) {
+                extra[key] = value
+            }
+        }
+        
+        for key, value := range overrides.Attributes {
+            extra[key] = value
+        }
+        
+        for key, value := range extra {
+            if _, exists := evt.Attributes[key]; ! exists {
+                evt.Attributes[key] = value
+            }
+        }
+        
+        if self.nodeMetadata != nil {
+            self.addNodeMeta(evt, self.nodeMetadata.Meta(healthCheck.Node))
+        }
+        
+        // how long it's been in this status, so Riemann can alert on checks
+        // that have been critical for a while without tracking state itself
+        if since, found := self.tracker.Since(healthCheck); found {
+            evt.Metric = int64(now.Sub(since) / time.Second)
+            evt.Attributes["since"] = since.UTC().Format(time.RFC3339)
+        }
+        
+        if changes, flapping := self.tracker.Flapping(healthCheck); flapping {
+            evt.State = "flapping"
+            evt.Metric = changes
+            evt.Attributes["consul_status"] = healthCheck.Status
+        }
+        
+        reason, inMaintenance := maint.reason(healthCheck)
+        inMaintenance = inMaintenance && self.maintenanceState != ""
+        
+        if inMaintenance {
+            // drained intentionally; nobody needs to be paged
+            evt.State = self.maintenanceState
+            evt.Tags = append(evt.Tags, "maintenance")
+            evt.Attributes["maintenance_reason"] = reason
+        }
+        
+        if healthCheck.CheckID == "serfHealth" {
+            serfEvents[healthCheck.Node] = evt
+        } else if down[healthCheck.Node] && ! inMaintenance {
+            if self.nodeDownMode == NodeDownCollapse {
+                collapsed[healthCheck.Node] = append(collapsed[healthCheck.Node], healthCheck.CheckID)
+                continue
+            }
+            
+            evt.Tags = append(evt.Tags, "suppressed")
+            evt.Attributes["suppressed_by"] = "serfHealth"
+        }
+        
+        events = append(events, evt)
+    }
+    
+    for node, checkIDs := range collapsed {
+        // the node's down, so it has a serfHealth check, but its event may
+        // not have been produced
+        if serfEvent, found := serfEvents[node]; found {
+            serfEvent.Attributes["suppressed_checks"] = strings.Join(checkIDs, ",")
+        }
+    }
+    
+    return events
+}
+
+// adds the selected node metadata, as node_meta.<key> attributes so they don't
+// collide with our own
+func (self *RiemannSink) addNodeMeta(evt *raidman.Event, meta map[string]string) {
+    for _, key := range self.nodeMetaAttrs {
+        if value, found := meta[key]; found {
+            evt.Attributes["node_meta." + key] = value
+        }
+    }
+    
+    for _, key := range self.nodeMetaTags {
+        if value, found := meta[key]; found {
+            evt.Tags = append(evt.Tags, key + ":" + value)
+        }
+    }
+}
+
+// final events for checks that are no longer in Consul
+func (self *RiemannSink) expiredEvents(vanished []checkState) []*raidman.Event {
+    var events []*raidman.Event
+    
+    fencingToken := strconv.FormatUint(self.fencingToken(), 10)
+    
+    for _, state := range vanished {
+        // under the same name and for as long as its last event, so this one
+        // replaces it
+        service := state.Service
+        if service == "" {
+            service = state.CheckID
+        }
+        
+        ttl := state.TTL
+        if ttl == 0 {
+            ttl = self.eventTTL
+        }
+        
+        events = append(events, &raidman.Event{
+            Ttl:         riemannTTL(ttl),
+            Time:        time.Now().Unix(),
+            Tags:        []string{ "consul", "deregistered" },
+            Host:        state.Node,
+            State:       self.expiredState,
+            Service:     service,
+            Description: "check deregistered from Consul",
+            Attributes:  map[string]string{
+                "reporting_node": self.nodeName,
+                "datacenter":     self.dc,
+                "last_status":    state.Status,
+                "fencing_token":  fencingToken,
+            },
+        })
+    }
+    
+    return events
+}
+
+// rollup events for each service.  these aren't about any one node, so the
+// datacenter is used as the host.
+func (self *RiemannSink) serviceRollupEvents(healthResults []HealthCheck) []*raidman.Event {
+    var events []*raidman.Event
+    
+    for serviceName, counts := range serviceRollups(healthResults) {
+        for _, evt := range rollupEvents(rollupName(self.serviceRollupFormat, serviceName), counts) {
+            evt.Attributes = map[string]string{
+                "consul_service": serviceName,
+            }
+            
+            events = append(events, evt)
+        }
+    }
+    
+    return self.completeRollupEvents(events, self.dc)
+}
+
+// rollup events for each node's checks, plus "<name> services" with the number
+// of services on the node.  the state is critical if serfHealth is failing.
+func (self *RiemannSink) nodeRollupEvents(healthResults []HealthCheck) []*raidman.Event {
+    var events []*raidman.Event
+    
+    for node, rollup := range nodeRollups(healthResults) {
+        nodeEvents := rollupEvents(self.nodeRollupName, &rollup.Checks)
+        nodeEvents[0].State = rollup.state()
+        nodeEvents[0].Attributes = map[string]string{
+            "serf_health": rollup.SerfHealth,
+        }
+        
+        nodeEvents = append(nodeEvents, &raidman.Event{
+            Service: self.nodeRollupName + " services",
+            State:   "ok",
+            Metric:  rollup.Services,
+        })
+        
+        events = append(events, self.completeRollupEvents(nodeEvents, node)...)
+    }
+    
+    return events
+}
+
+// fills in the rest of a rollup event
+func (self *RiemannSink) completeRollupEvents(events []*raidman.Event, host string) []*raidman.Event {
+    now := time.Now().Unix()
+    fencingToken := strconv.FormatUint(self.fencingToken(), 10)
+    
+    for _, evt := range events {
+        evt.Host = host
+        evt.Time = now
+        evt.Ttl = riemannTTL(self.eventTTL)
+        evt.Tags = []string{ "consul", "rollup" }
+        
+        if evt.Attributes == nil {
+            evt.Attributes = make(map[string]string)
+        }
+        
+        evt.Attributes["reporting_node"] = self.nodeName
+        evt.Attributes["datacenter"] = self.dc
+        evt.Attributes["fencing_token"] = fencingToken
+    }
+    
+    return events
+}
+
+func sendEvents(riemann RiemannClient, events []*raidman.Event) error {
+    for _, evt := range events {
+        err := riemann.Send(evt)
+        
+        if err != nil {
+            metricEventsFailed.Inc()
+            return err
+        }
+    }
+    
+    return nil
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+    "fmt"
+    "time"
+    "strings"
+    "encoding/json"
+
+    "github.com/stretchr/testify/mock"
+    "github.com/armon/consul-api"
+    "github.com/amir/raidman"
+    "github.com/bluestatedigital/riemann-consul-receiver/consul-mocks"
+)
+
+// collects the events sent to it
+type recordingRiemann struct {
+    events  []*raidman.Event
+    sendErr error
+    closed  bool
+}
+
+func (self *recordingRiemann) Send(evt *raidman.Event) error {
+    if self.sendErr != nil {
+        return self.sendErr
+    }
+    
+    self.events = append(self.events, evt)
+    return nil
+}
+
+func (self *recordingRiemann) Close() {
+    self.closed = true
+}
+
+var _ = Describe("RiemannSink", func() {
+    var riemann *recordingRiemann
+    var dials int
+    var sink *RiemannSink
+    
+    healthResults := []HealthCheck{
+        HealthCheck{ Node: "node1", CheckID: "serfHealth", Status: "passing" },
+        HealthCheck{ Node: "node1", CheckID: "service:web", Status: "passing", ServiceID: "web", ServiceName: "web" },
+        HealthCheck{ Node: "node2", CheckID: "serfHealth", Status: "critical" },
+        HealthCheck{ Node: "node2", CheckID: "service:web", Status: "passing", ServiceID: "web", ServiceName: "web" },
+    }
+    
+    // finds the event with the given host and service
+    findEvent := func(host, service string) *raidman.Event {
+        for _, evt := range riemann.events {
+            if evt.Host == host && evt.Service == service {
+                return evt
+            }
+        }
+        
+        return nil
+    }
+    
+    BeforeEach(func() {
+        riemann = &recordingRiemann{}
+        dials = 0
+        
+        sink = NewRiemannSink(
+            func() (RiemannClient, error) {
+                dials += 1
+                return riemann, nil
+            },
+            time.Minute,
+            "reporting-node",
+            "dc1",
+            func() uint64 { return 42 },
+        )
+    })
+    
+    It("sends an event per check", func() {
+        Expect(sink.Open()).To(BeNil())
+        Expect(sink.Send(healthResults)).To(BeNil())
+        
+        Expect(riemann.events).To(HaveLen(4))
+        
+        evt := findEvent("node2", "serfHealth")
+        Expect(evt).NotTo(BeNil())
+        Expect(evt.State).To(Equal("critical"))
+        Expect(evt.Ttl).To(Equal(float32(180)))
+        Expect(evt.Attributes).To(HaveKeyWithValue("fencing_token", "42"))
+        Expect(evt.Attributes).To(HaveKeyWithValue("reporting_node", "reporting-node"))
+    })
+    
+    It("reconnects after a failed send", func() {
+        riemann.sendErr = fmt.Errorf("broken pipe")
+        
+        sink.Open()
+        Expect(sink.Send(healthResults)).NotTo(BeNil())
+        Expect(riemann.closed).To(Equal(true))
+        
+        riemann.sendErr = nil
+        Expect(sink.Send(healthResults)).To(BeNil())
+        Expect(dials).To(Equal(2))
+    })
+    
+    It("rejects a rollup format without a placeholder", func() {
+        Expect(sink.UseServiceRollups("consul service")).NotTo(BeNil())
+    })
+    
+    It("sends service rollups", func() {
+        Expect(sink.UseServiceRollups("consul service %s")).To(BeNil())
+        
+        sink.Open()
+        Expect(sink.Send(healthResults)).To(BeNil())
+        
+        // node2 is critical, so its web instance is too
+        evt := findEvent("dc1", "consul service web")
+        Expect(evt).NotTo(BeNil())
+        Expect(evt.State).To(Equal("warning"))
+        Expect(evt.Metric).To(Equal(float64(50)))
+        Expect(evt.Attributes).To(HaveKeyWithValue("consul_service", "web"))
+        Expect(evt.Tags).To(ContainElement("rollup"))
+        
+        Expect(findEvent("dc1", "consul service web total").Metric).To(Equal(2))
+        Expect(findEvent("dc1", "consul service web passing").Metric).To(Equal(1))
+        Expect(findEvent("dc1", "consul service web critical").Metric).To(Equal(1))
+    })
+    
+    It("sends node rollups", func() {
+        sink.UseNodeRollups("consul node")
+        
+        sink.Open()
+        Expect(sink.Send(healthResults)).To(BeNil())
+        
+        // the web check is passing, but the node's gone
+        evt := findEvent("node2", "consul node")
+        Expect(evt).NotTo(BeNil())
+        Expect(evt.State).To(Equal("critical"))
+        Expect(evt.Metric).To(Equal(float64(50)))
+        Expect(evt.Attributes).To(HaveKeyWithValue("serf_health", "critical"))
+        
+        Expect(findEvent("node2", "consul node critical").Metric).To(Equal(1))
+        Expect(findEvent("node2", "consul node services").Metric).To(Equal(1))
+        
+        Expect(findEvent("node1", "consul node").State).To(Equal("ok"))
+    })
+    
+    It("rejects an unknown node-down mode", func() {
+        Expect(sink.UseNodeDownMode("ignore")).NotTo(BeNil())
+    })
+    
+    It("tags the checks of a node that's down", func() {
+        Expect(sink.UseNodeDownMode(NodeDownTag)).To(BeNil())
+        
+        sink.Open()
+        Expect(sink.Send(healthResults)).To(BeNil())
+        Expect(riemann.events).To(HaveLen(4))
+        
+        evt := findEvent("node2", "service:web")
+        Expect(evt.Tags).To(ContainElement("suppressed"))
+        Expect(evt.Attributes).To(HaveKeyWithValue("suppressed_by", "serfHealth"))
+        
+        Expect(findEvent("node2", "serfHealth").Tags).NotTo(ContainElement("suppressed"))
+        Expect(findEvent("node1", "service:web").Tags).NotTo(ContainElement("suppressed"))
+    })
+    
+    It("collapses the checks of a node that's down", func() {
+        Expect(sink.UseNodeDownMode(NodeDownCollapse)).To(BeNil())
+        
+        sink.Open()
+        Expect(sink.Send(healthResults)).To(BeNil())
+        Expect(riemann.events).To(HaveLen(3))
+        
+        Expect(findEvent("node2", "service:web")).To(BeNil())
+        Expect(findEvent("node2", "serfHealth").Attributes).To(HaveKeyWithValue("suppressed_checks", "service:web"))
+        Expect(findEvent("node1", "service:web")).NotTo(BeNil())
+    })
+    
+    It("maps checks in maintenance mode to the maintenance state", func() {
+        sink.UseMaintenanceState("maintenance")
+        
+        sink.Open()
+        Expect(sink.Send([]HealthCheck{
+            HealthCheck{ Node: "node1", CheckID: "_service_maintenance:web", Status: "critical", Notes: "deploying", ServiceID: "web", ServiceName: "web" },
+            HealthCheck{ Node: "node1", CheckID: "service:web", Status: "critical", ServiceID: "web", ServiceName: "web" },
+            HealthCheck{ Node: "node1", CheckID: "service:db", Status: "critical", ServiceID: "db", ServiceName: "db" },
+        })).To(BeNil())
+        
+        evt := findEvent("node1", "service:web")
+        Expect(evt.State).To(Equal("maintenance"))
+        Expect(evt.Tags).To(ContainElement("maintenance"))
+        Expect(evt.Attributes).To(HaveKeyWithValue("maintenance_reason", "deploying"))
+        
+        Expect(findEvent("node1", "_service_maintenance:web").State).To(Equal("maintenance"))
+        Expect(findEvent("node1", "service:db").State).To(Equal("critical"))
+    })
+    
+    It("sends maintenance checks as-is without a maintenance state", func() {
+        sink.Open()
+        Expect(sink.Send([]HealthCheck{
+            HealthCheck{ Node: "node1", CheckID: "_node_maintenance", Status: "critical", Notes: "kernel upgrade" },
+        })).To(BeNil())
+        
+        Expect(findEvent("node1", "_node_maintenance").State).To(Equal("critical"))
+    })
+    
+    It("rejects a flap threshold that's too low", func() {
+        Expect(sink.UseFlapDetection(10 * time.Minute, 1)).NotTo(BeNil())
+        Expect(sink.UseFlapDetection(time.Second, 3)).NotTo(BeNil())
+    })
+    
+    It("sends flapping checks with the flapping state", func() {
+        Expect(sink.UseFlapDetection(10 * time.Minute, 2)).To(BeNil())
+        sink.Open()
+        
+        for _, status := range []string{ "passing", "critical", "passing" } {
+            riemann.events = nil
+            
+            Expect(sink.Send([]HealthCheck{
+                HealthCheck{ Node: "node1", CheckID: "service:web", Status: status, ServiceID: "web", ServiceName: "web" },
+            })).To(BeNil())
+        }
+        
+        evt := findEvent("node1", "service:web")
+        Expect(evt.State).To(Equal("flapping"))
+        Expect(evt.Metric).To(Equal(2))
+        Expect(evt.Attributes).To(HaveKeyWithValue("consul_status", "passing"))
+    })
+    
+    It("sends the time in state", func() {
+        sink.Open()
+        Expect(sink.Send(healthResults)).To(BeNil())
+        
+        evt := findEvent("node1", "serfHealth")
+        Expect(evt.Metric).To(Equal(int64(0)))
+        Expect(evt.Attributes).To(HaveKey("since"))
+    })
+    
+    It("continues the time in state from the store", func() {
+        mockKV := consulmocks.MockKV{}
+        
+        since := time.Now().Add(-10 * time.Minute).UTC()
+        node1, _ := json.Marshal(nodeCheckStates{ Checks: []checkState{
+            checkState{ Node: "node1", CheckID: "serfHealth", Status: "critical", Since: since },
+        }})
+        node2, _ := json.Marshal(nodeCheckStates{ Checks: []checkState{
+            checkState{ Node: "node2", CheckID: "serfHealth", Status: "critical", Since: since },
+        }})
+        
+        var nilQueryOpts *consulapi.QueryOptions = nil
+        var nilWriteOpts *consulapi.WriteOptions = nil
+        
+        mockKV.On("List", "some/prefix/", nilQueryOpts).Return(consulapi.KVPairs{
+            &consulapi.KVPair{ Key: "some/prefix/node1", Value: node1, ModifyIndex: 10 },
+            &consulapi.KVPair{ Key: "some/prefix/node2", Value: node2, ModifyIndex: 11 },
+        }, &consulapi.QueryMeta{}, nil)
+        mockKV.On("CAS", mock.AnythingOfType("*consulapi.KVPair"), nilWriteOpts).Return(true, &consulapi.WriteMeta{}, nil)
+        mockKV.On("Get", mock.AnythingOfType("string"), nilQueryOpts).Return(&consulapi.KVPair{ ModifyIndex: 12 }, &consulapi.QueryMeta{}, nil)
+        
+        sink.UseCheckStateStore(NewCheckStateStore(&mockKV, "some/prefix", func() uint64 { return 1 }))
+        
+        Expect(sink.Open()).To(BeNil())
+        Expect(sink.Send(healthResults)).To(BeNil())
+        
+        // still critical
+        evt := findEvent("node2", "serfHealth")
+        Expect(evt.Metric).To(BeNumerically(">=", 600))
+        Expect(evt.Attributes).To(HaveKeyWithValue("since", since.Format(time.RFC3339)))
+        
+        // now passing
+        Expect(findEvent("node1", "serfHealth").Metric).To(BeNumerically("<", 600))
+        
+        // every node's checks were labelled, so each node's states were saved
+        var saved []checkState
+        for _, call := range mockKV.Calls {
+            if call.Method == "CAS" {
+                var stored nodeCheckStates
+                json.Unmarshal(call.Arguments.Get(0).(*consulapi.KVPair).Value, &stored)
+                saved = append(saved, stored.Checks...)
+            }
+        }
+        
+        Expect(saved).To(HaveLen(4))
+    })
+    
+    It("sends a final event for checks that disappear", func() {
+        sink.UseExpiredState("expired")
+        sink.Open()
+        
+        Expect(sink.Send(healthResults)).To(BeNil())
+        
+        riemann.events = nil
+        Expect(sink.Send(healthResults[:2])).To(BeNil())
+        
+        Expect(riemann.events).To(HaveLen(4))
+        
+        evt := findEvent("node2", "serfHealth")
+        Expect(evt.State).To(Equal("expired"))
+        Expect(evt.Tags).To(ContainElement("deregistered"))
+        Expect(evt.Attributes).To(HaveKeyWithValue("last_status", "critical"))
+        
+        // only once
+        riemann.events = nil
+        Expect(sink.Send(healthResults[:2])).To(BeNil())
+        Expect(riemann.events).To(HaveLen(2))
+    })
+    
+    It("tries the final events again if sending fails", func() {
+        sink.UseExpiredState("expired")
+        sink.Open()
+        
+        Expect(sink.Send(healthResults)).To(BeNil())
+        
+        riemann.sendErr = fmt.Errorf("connection reset")
+        Expect(sink.Send(healthResults[:2])).NotTo(BeNil())
+        
+        riemann.sendErr = nil
+        riemann.events = nil
+        Expect(sink.Send(healthResults[:2])).To(BeNil())
+        
+        Expect(findEvent("node2", "serfHealth").State).To(Equal("expired"))
+    })
+    
+    It("sends the final event under the check's service name and TTL", func() {
+        sink.UseExpiredState("expired")
+        sink.Open()
+        
+        payments := HealthCheck{ Node: "node1", CheckID: "service:pay1", Status: "passing", ServiceID: "pay1", ServiceName: "payments", Tags: []string{ "riemann:service=payments", "riemann:ttl=10m" } }
+        
+        Expect(sink.Send([]HealthCheck{ payments })).To(BeNil())
+        
+        riemann.events = nil
+        Expect(sink.Send([]HealthCheck{})).To(BeNil())
+        
+        Expect(riemann.events).To(HaveLen(1))
+        Expect(riemann.events[0].Service).To(Equal("payments"))
+        Expect(riemann.events[0].Ttl).To(Equal(float32(600)))
+    })
+    
+    It("neither tracks nor expires ignored checks", func() {
+        sink.UseExpiredState("expired")
+        sink.Open()
+        
+        scratch := HealthCheck{ Node: "node1", CheckID: "service:scratch", Status: "critical", ServiceID: "scratch", ServiceName: "scratch", Tags: []string{ "riemann:ignore" } }
+        
+        Expect(sink.Send([]HealthCheck{ scratch })).To(BeNil())
+        
+        _, tracked := sink.tracker.Since(scratch)
+        Expect(tracked).To(Equal(false))
+        
+        Expect(sink.Send([]HealthCheck{})).To(BeNil())
+        Expect(riemann.events).To(BeEmpty())
+    })
+    
+    It("uses the configured event TTL unless the service overrides it", func() {
+        Expect(sink.UseEventTTL(30 * time.Second)).NotTo(BeNil())
+        Expect(sink.UseEventTTL(90 * time.Second)).To(BeNil())
+        
+        sink.Open()
+        Expect(sink.Send([]HealthCheck{
+            HealthCheck{ Node: "node1", CheckID: "serfHealth", Status: "passing" },
+            HealthCheck{ Node: "node1", CheckID: "service:batch", Status: "passing", ServiceID: "batch", ServiceName: "batch", Tags: []string{ "riemann-ttl=600" } },
+        })).To(BeNil())
+        
+        Expect(findEvent("node1", "serfHealth").Ttl).To(Equal(float32(90)))
+        Expect(findEvent("node1", "service:batch").Ttl).To(Equal(float32(600)))
+    })
+    
+    It("applies service control tags", func() {
+        sink.Open()
+        Expect(sink.Send([]HealthCheck{
+            HealthCheck{ Node: "node1", CheckID: "service:pay1", Status: "passing", ServiceID: "pay1", ServiceName: "payments", Tags: []string{ "v2", "riemann:service=payments", "riemann:attr.team=payments" } },
+            HealthCheck{ Node: "node1", CheckID: "service:scratch", Status: "critical", ServiceID: "scratch", ServiceName: "scratch", Tags: []string{ "riemann:ignore" } },
+        })).To(BeNil())
+        
+        Expect(riemann.events).To(HaveLen(1))
+        
+        evt := findEvent("node1", "payments")
+        Expect(evt).NotTo(BeNil())
+        Expect(evt.Tags).To(Equal([]string{ "v2", "consul" }))
+        Expect(evt.Attributes).To(HaveKeyWithValue("team", "payments"))
+    })
+    
+    It("adds service metadata from KV", func() {
+        mockKV := consulmocks.MockKV{}
+        mockKV.On("List", "services/", mock.AnythingOfType("*consulapi.QueryOptions")).Return(
+            consulapi.KVPairs{
+                &consulapi.KVPair{ Key: "services/web/meta", Value: []byte(`{"team": "web", "owner": "alice", "datacenter": "nope"}`) },
+            },
+            &consulapi.QueryMeta{ LastIndex: 42 },
+            nil,
+        )
+        
+        metadata := NewServiceMetadata(&mockKV, "services", time.Minute)
+        metadata.Refresh(0)
+        sink.UseServiceMetadata(metadata)
+        
+        sink.Open()
+        Expect(sink.Send([]HealthCheck{
+            HealthCheck{ Node: "node1", CheckID: "service:web", Status: "passing", ServiceID: "web", ServiceName: "web", Tags: []string{ "riemann:attr.owner=bob" } },
+        })).To(BeNil())
+        
+        evt := findEvent("node1", "service:web")
+        Expect(evt.Attributes).To(HaveKeyWithValue("team", "web"))
+        Expect(evt.Attributes).To(HaveKeyWithValue("owner", "bob"))
+        Expect(evt.Attributes).To(HaveKeyWithValue("datacenter", "dc1"))
+    })
+    
+    It("adds selected node metadata", func() {
+        mockCatalog := consulmocks.MockCatalog{}
+        mockCatalog.On("NodeMeta", mock.AnythingOfType("*consulapi.QueryOptions")).Return(
+            map[string]map[string]string{
+                "node1": map[string]string{ "rack": "r1", "az": "us-east-1a", "secret": "shh" },
+            },
+            &consulapi.QueryMeta{ LastIndex: 42 },
+            nil,
+        )
+        
+        nodeMetadata := NewNodeMetadata(&mockCatalog, time.Minute)
+        nodeMetadata.Refresh(0)
+        sink.UseNodeMetadata(nodeMetadata, []string{ "rack", "missing" }, []string{ "az" })
+        
+        sink.Open()
+        Expect(sink.Send(healthResults)).To(BeNil())
+        
+        evt := findEvent("node1", "serfHealth")
+        Expect(evt.Attributes).To(HaveKeyWithValue("node_meta.rack", "r1"))
+        Expect(evt.Attributes).NotTo(HaveKey("node_meta.missing"))
+        Expect(evt.Attributes).NotTo(HaveKey("node_meta.secret"))
+        Expect(evt.Tags).To(ContainElement("az:us-east-1a"))
+        
+        Expect(findEvent("node2", "serfHealth").Attributes).NotTo(HaveKey("node_meta.rack"))
+    })
+    
+    It("includes check details", func() {
+        sink.Open()
+        Expect(sink.Send([]HealthCheck{
+            HealthCheck{
+                Node:         "node1",
+                CheckID:      "service:web",
+                Status:       "critical",
+                ServiceID:    "web",
+                ServiceName:  "web",
+                CheckDetails: CheckDetails{ CheckType: "http", Interval: "10s", Target: "http://localhost/" },
+            },
+        })).To(BeNil())
+        
+        evt := findEvent("node1", "service:web")
+        Expect(evt.Attributes).To(HaveKeyWithValue("check_type", "http"))
+        Expect(evt.Attributes).To(HaveKeyWithValue("check_interval", "10s"))
+        Expect(evt.Attributes).To(HaveKeyWithValue("check_target", "http://localhost/"))
+        Expect(evt.Attributes).NotTo(HaveKey("check_timeout"))
+    })
+    
+    It("filters check output", func() {
+        filter, _ := NewOutputFilter(32, 0, []string{ `password=\S+` })
+        sink.UseOutputFilter(filter)
+        
+        sink.Open()
+        Expect(sink.Send([]HealthCheck{
+            HealthCheck{
+                Node:    "node1",
+                CheckID: "serfHealth",
+                Status:  "passing",
+                Output:  "\x1b[1mpassword=hunter2\x1b[0m " + strings.Repeat("ok ", 100),
+            },
+        })).To(BeNil())
+        
+        evt := findEvent("node1", "serfHealth")
+        Expect(evt.Description).To(HaveLen(32))
+        Expect(evt.Description).To(ContainSubstring("[REDACTED]"))
+        Expect(evt.Description).NotTo(ContainSubstring("hunter2"))
+        Expect(evt.Description).NotTo(ContainSubstring("\x1b"))
+    })
+})
@@ -0,0 +1,177 @@
+package main
+
+import (
+    "strings"
+
+    "github.com/amir/raidman"
+)
+
+// number of instances in each status
+type healthCounts struct {
+    Total    int
+    Passing  int
+    Warning  int
+    Critical int
+}
+
+func (self *healthCounts) add(status string) {
+    self.Total += 1
+    
+    switch status {
+        case "passing":
+            self.Passing += 1
+        
+        case "warning":
+            self.Warning += 1
+        
+        case "critical":
+            self.Critical += 1
+    }
+}
+
+func (self *healthCounts) percentHealthy() float64 {
+    if self.Total == 0 {
+        return 0
+    }
+    
+    return float64(self.Passing) * 100 / float64(self.Total)
+}
+
+// ok if everything's passing, critical if nothing is
+func (self *healthCounts) state() string {
+    if self.Passing == self.Total {
+        return "ok"
+    } else if self.Passing == 0 {
+        return "critical"
+    }
+    
+    return "warning"
+}
+
+// the more severe of two Consul statuses
+func worseStatus(status1, status2 string) string {
+    if status1 == "" || statusValues[status2] > statusValues[status1] {
+        return status2
+    }
+    
+    return status1
+}
+
+// counts the instances of each service by status.  an instance is a service on
+// a node, and as with Consul's health endpoint its status is the worst of its
+// own checks and those of its node.  maintenance mode checks are ignored, so
+// a drained instance counts according to its real checks.
+func serviceRollups(healthResults []HealthCheck) map[string]*healthCounts {
+    nodeStatuses := make(map[string]string)
+    instanceStatuses := make(map[nodeServiceKey]string)
+    instanceServices := make(map[nodeServiceKey]string)
+    
+    for _, healthCheck := range healthResults {
+        if isMaintenanceCheck(healthCheck.CheckID) {
+            continue
+        }
+        
+        if healthCheck.ServiceID == "" {
+            nodeStatuses[healthCheck.Node] = worseStatus(nodeStatuses[healthCheck.Node], healthCheck.Status)
+        } else {
+            key := nodeServiceKey{ healthCheck.Node, healthCheck.ServiceID }
+            
+            instanceStatuses[key] = worseStatus(instanceStatuses[key], healthCheck.Status)
+            instanceServices[key] = healthCheck.ServiceName
+        }
+    }
+    
+    rollups := make(map[string]*healthCounts)
+    
+    for key, status := range instanceStatuses {
+        serviceName := instanceServices[key]
+        
+        counts, found := rollups[serviceName]
+        if ! found {
+            counts = &healthCounts{}
+            rollups[serviceName] = counts
+        }
+        
+        if nodeStatus, found := nodeStatuses[key.Node]; found {
+            status = worseStatus(status, nodeStatus)
+        }
+        
+        counts.add(status)
+    }
+    
+    return rollups
+}
+
+// summary of the checks on a node
+type nodeRollup struct {
+    Checks     healthCounts
+    
+    // status of the serfHealth check; empty if there isn't one
+    SerfHealth string
+    
+    // number of services registered on the node, by id
+    Services   int
+}
+
+// ok unless serfHealth is failing, in which case the node's probably gone and
+// its other checks don't mean much
+func (self *nodeRollup) state() string {
+    if self.SerfHealth == "critical" {
+        return "critical"
+    }
+    
+    return self.Checks.state()
+}
+
+// summarizes the checks on each node, ignoring maintenance mode checks
+func nodeRollups(healthResults []HealthCheck) map[string]*nodeRollup {
+    rollups := make(map[string]*nodeRollup)
+    services := make(map[nodeServiceKey]bool)
+    
+    for _, healthCheck := range healthResults {
+        if isMaintenanceCheck(healthCheck.CheckID) {
+            continue
+        }
+        
+        rollup, found := rollups[healthCheck.Node]
+        if ! found {
+            rollup = &nodeRollup{}
+            rollups[healthCheck.Node] = rollup
+        }
+        
+        rollup.Checks.add(healthCheck.Status)
+        
+        if healthCheck.CheckID == "serfHealth" {
+            rollup.SerfHealth = healthCheck.Status
+        }
+        
+        if healthCheck.ServiceID != "" {
+            key := nodeServiceKey{ healthCheck.Node, healthCheck.ServiceID }
+            
+            if ! services[key] {
+                services[key] = true
+                rollup.Services += 1
+            }
+        }
+    }
+    
+    return rollups
+}
+
+// events for a rollup: the percentage of healthy instances, with a state, as
+// <name>, and the number of instances in total and in each status as
+// "<name> total", "<name> passing", etc.
+func rollupEvents(name string, counts *healthCounts) []*raidman.Event {
+    return []*raidman.Event{
+        &raidman.Event{ Service: name,               State: counts.state(), Metric: counts.percentHealthy() },
+        &raidman.Event{ Service: name + " total",    State: "ok",           Metric: counts.Total },
+        &raidman.Event{ Service: name + " passing",  State: "ok",           Metric: counts.Passing },
+        &raidman.Event{ Service: name + " warning",  State: "ok",           Metric: counts.Warning },
+        &raidman.Event{ Service: name + " critical", State: "ok",           Metric: counts.Critical },
+    }
+}
+
+// the service name for a rollup, from a format like "consul service %s"
+func rollupName(format, name string) string {
+    return strings.Replace(format, "%s", name, 1)
+}
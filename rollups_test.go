@@ -0,0 +1,52 @@
+package main
+
+var _ = Describe("rollups", func() {
+    It("takes the worst of a service's checks", func() {
+        rollups := serviceRollups([]HealthCheck{
+            HealthCheck{ Node: "node1", CheckID: "service:web",     Status: "passing", ServiceID: "web",  ServiceName: "web" },
+            HealthCheck{ Node: "node1", CheckID: "service:web:2",   Status: "warning", ServiceID: "web",  ServiceName: "web" },
+            HealthCheck{ Node: "node2", CheckID: "service:web-alt", Status: "passing", ServiceID: "web-alt", ServiceName: "web" },
+            HealthCheck{ Node: "node2", CheckID: "service:db",      Status: "passing", ServiceID: "db",   ServiceName: "db" },
+        })
+        
+        Expect(rollups).To(HaveLen(2))
+        Expect(*rollups["web"]).To(Equal(healthCounts{ Total: 2, Passing: 1, Warning: 1 }))
+        Expect(*rollups["db"]).To(Equal(healthCounts{ Total: 1, Passing: 1 }))
+    })
+    
+    It("counts each instance of a service on a node", func() {
+        rollups := serviceRollups([]HealthCheck{
+            HealthCheck{ Node: "node1", CheckID: "service:web1", Status: "passing",  ServiceID: "web1", ServiceName: "web" },
+            HealthCheck{ Node: "node1", CheckID: "service:web2", Status: "critical", ServiceID: "web2", ServiceName: "web" },
+        })
+        
+        Expect(*rollups["web"]).To(Equal(healthCounts{ Total: 2, Passing: 1, Critical: 1 }))
+    })
+    
+    It("computes the percentage healthy and state", func() {
+        counts := healthCounts{ Total: 4, Passing: 3, Critical: 1 }
+        Expect(counts.percentHealthy()).To(Equal(float64(75)))
+        Expect(counts.state()).To(Equal("warning"))
+        
+        counts = healthCounts{ Total: 2, Passing: 2 }
+        Expect(counts.state()).To(Equal("ok"))
+        
+        counts = healthCounts{ Total: 2, Warning: 2 }
+        Expect(counts.state()).To(Equal("critical"))
+    })
+    
+    It("summarizes each node", func() {
+        rollups := nodeRollups([]HealthCheck{
+            HealthCheck{ Node: "node1", CheckID: "serfHealth",   Status: "critical" },
+            HealthCheck{ Node: "node1", CheckID: "service:web",  Status: "passing", ServiceID: "web", ServiceName: "web" },
+            HealthCheck{ Node: "node1", CheckID: "service:web2", Status: "warning", ServiceID: "web", ServiceName: "web" },
+            HealthCheck{ Node: "node1", CheckID: "service:db",   Status: "passing", ServiceID: "db",  ServiceName: "db" },
+        })
+        
+        Expect(rollups).To(HaveLen(1))
+        Expect(rollups["node1"].Checks).To(Equal(healthCounts{ Total: 4, Passing: 2, Warning: 1, Critical: 1 }))
+        Expect(rollups["node1"].SerfHealth).To(Equal("critical"))
+        Expect(rollups["node1"].Services).To(Equal(2))
+        Expect(rollups["node1"].state()).To(Equal("critical"))
+    })
+})
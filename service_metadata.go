@@ -0,0 +1,125 @@
+package main
+
+import (
+    "sync"
+    "time"
+    "strings"
+    "encoding/json"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/armon/consul-api"
+)
+
+// ServiceMetadata watches a KV prefix for information about services (owning
+// team, pager rotation, runbook, etc.) to add to the attributes of their
+// events.  For a prefix of "services", the metadata for the "payments" service
+// is read from either or both of
+//
+//   services/payments/meta         a JSON object of attributes
+//   services/payments/meta/<name>  a single attribute
+type ServiceMetadata struct {
+    kv             ConsulKV
+    prefix         string
+    updateInterval time.Duration
+    
+    lock       sync.RWMutex
+    attributes map[string]map[string]string
+}
+
+func NewServiceMetadata(kv ConsulKV, prefix string, updateInterval time.Duration) *ServiceMetadata {
+    return &ServiceMetadata{
+        kv:             kv,
+        prefix:         strings.Trim(prefix, "/"),
+        updateInterval: updateInterval,
+        attributes:     make(map[string]map[string]string),
+    }
+}
+
+// the attributes for the service; must not be modified
+func (self *ServiceMetadata) Attributes(serviceName string) map[string]string {
+    self.lock.RLock()
+    defer self.lock.RUnlock()
+    
+    return self.attributes[serviceName]
+}
+
+// retrieves the metadata, blocking for up to the update interval if waitIdx is
+// non-zero and nothing has changed.  returns the index for the next call.
+func (self *ServiceMetadata) Refresh(waitIdx uint64) (uint64, error) {
+    start := time.Now()
+    pairs, queryMeta, err := self.kv.List(self.prefix + "/", &consulapi.QueryOptions{
+        WaitIndex: waitIdx,
+        WaitTime:  self.updateInterval,
+    })
+    observeConsulCall("kv_list", start, queryMeta, err)
+    observeBlockingQuery("kv_list", waitIdx, queryMeta)
+    
+    if err != nil {
+        return waitIdx, err
+    }
+    
+    attributes := parseServiceMetadata(self.prefix, pairs)
+    
+    self.lock.Lock()
+    self.attributes = attributes
+    self.lock.Unlock()
+    
+    return queryMeta.LastIndex, nil
+}
+
+// keeps the metadata up to date until done is closed
+func (self *ServiceMetadata) Watch(done <-chan interface{}) {
+    watchBlockingQuery(done, self.updateInterval, "unable to retrieve service metadata", self.Refresh)
+}
+
+func parseServiceMetadata(prefix string, pairs consulapi.KVPairs) map[string]map[string]string {
+    attributes := make(map[string]map[string]string)
+    
+    // single attributes are applied after the JSON objects, so they win
+    var singles []*consulapi.KVPair
+    
+    for _, kvp := range pairs {
+        // <service>/meta or <service>/meta/<name>
+        parts := strings.SplitN(strings.TrimPrefix(kvp.Key, prefix + "/"), "/", 3)
+        
+        if len(parts) < 2 || parts[1] != "meta" {
+            continue
+        }
+        
+        serviceName := parts[0]
+        if _, found := attributes[serviceName]; ! found {
+            attributes[serviceName] = make(map[string]string)
+        }
+        
+        if len(parts) == 3 {
+            if parts[2] != "" {
+                singles = append(singles, kvp)
+            }
+            
+            continue
+        }
+        
+        var values map[string]interface{}
+        if err := json.Unmarshal(kvp.Value, &values); err != nil {
+            log.Warnf("ignoring %s: %v", kvp.Key, err)
+            continue
+        }
+        
+        for name, value := range values {
+            if str, ok := value.(string); ok {
+                attributes[serviceName][name] = str
+            } else {
+                encoded, _ := json.Marshal(value)
+                attributes[serviceName][name] = string(encoded)
+            }
+        }
+    }
+    
+    for _, kvp := range singles {
+        parts := strings.SplitN(strings.TrimPrefix(kvp.Key, prefix + "/"), "/", 3)
+        
+        attributes[parts[0]][parts[2]] = string(kvp.Value)
+    }
+    
+    return attributes
+}
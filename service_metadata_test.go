@@ -0,0 +1,72 @@
+package main
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/stretchr/testify/mock"
+    "github.com/armon/consul-api"
+    "github.com/bluestatedigital/riemann-consul-receiver/consul-mocks"
+)
+
+var _ = Describe("ServiceMetadata", func() {
+    var mockKV   consulmocks.MockKV
+    var metadata *ServiceMetadata
+    
+    genericQueryOpts := mock.AnythingOfType("*consulapi.QueryOptions")
+    
+    BeforeEach(func() {
+        mockKV = consulmocks.MockKV{}
+        metadata = NewServiceMetadata(&mockKV, "/services/", time.Minute)
+    })
+    
+    It("reads JSON objects and single attributes", func() {
+        mockKV.On("List", "services/", genericQueryOpts).Return(
+            consulapi.KVPairs{
+                &consulapi.KVPair{ Key: "services/payments/meta", Value: []byte(`{"team": "payments", "tier": 1}`) },
+                &consulapi.KVPair{ Key: "services/payments/meta/runbook", Value: []byte("http://wiki/payments") },
+                &consulapi.KVPair{ Key: "services/payments/meta/team", Value: []byte("billing") },
+                &consulapi.KVPair{ Key: "services/payments/config/threads", Value: []byte("4") },
+                &consulapi.KVPair{ Key: "services/search/meta/pager", Value: []byte("search-oncall") },
+            },
+            &consulapi.QueryMeta{ LastIndex: 42 },
+            nil,
+        )
+        
+        waitIdx, err := metadata.Refresh(0)
+        Expect(err).To(BeNil())
+        Expect(waitIdx).To(Equal(uint64(42)))
+        
+        Expect(metadata.Attributes("payments")).To(Equal(map[string]string{
+            "team":    "billing",
+            "tier":    "1",
+            "runbook": "http://wiki/payments",
+        }))
+        
+        Expect(metadata.Attributes("search")).To(HaveKeyWithValue("pager", "search-oncall"))
+        Expect(metadata.Attributes("unknown")).To(BeEmpty())
+        
+        opts := mockKV.Calls[0].Arguments.Get(1).(*consulapi.QueryOptions)
+        Expect(opts.WaitIndex).To(Equal(uint64(0)))
+        Expect(opts.WaitTime).To(Equal(time.Minute))
+    })
+    
+    It("keeps the previous metadata on error", func() {
+        mockKV.On("List", "services/", genericQueryOpts).Return(
+            consulapi.KVPairs{
+                &consulapi.KVPair{ Key: "services/search/meta/pager", Value: []byte("search-oncall") },
+            },
+            &consulapi.QueryMeta{ LastIndex: 42 },
+            nil,
+        ).Once()
+        
+        mockKV.On("List", "services/", genericQueryOpts).Return(nil, nil, fmt.Errorf("no leader")).Once()
+        
+        metadata.Refresh(0)
+        
+        waitIdx, err := metadata.Refresh(42)
+        Expect(err).NotTo(BeNil())
+        Expect(waitIdx).To(Equal(uint64(42)))
+        Expect(metadata.Attributes("search")).To(HaveKeyWithValue("pager", "search-oncall"))
+    })
+})
@@ -0,0 +1,107 @@
+package main
+
+import (
+    "fmt"
+    "time"
+    "strings"
+)
+
+// Consul service tags starting with this prefix control how the service's
+// checks are sent to Riemann, and aren't forwarded as event tags:
+//
+//   riemann:service=<name>      event service name instead of the check id
+//   riemann:ttl=<ttl>           event TTL; see parseTTL
+//   riemann:ignore              don't send events for the service's checks
+//   riemann:attr.<key>=<value>  extra event attribute
+const controlTagPrefix = "riemann:"
+
+// how a service's tags modify the events for its checks
+type eventOverrides struct {
+    Service    string
+    TTL        time.Duration
+    Ignore     bool
+    Attributes map[string]string
+    
+    // the service's tags without the control tags
+    Tags       []string
+}
+
+// parses a service's control tags.  invalid ones are skipped and returned as
+// errors.
+func parseEventOverrides(tags []string, updateInterval time.Duration) (*eventOverrides, []error) {
+    overrides := &eventOverrides{
+        Attributes: make(map[string]string),
+    }
+    
+    var errs []error
+    
+    for _, tag := range tags {
+        var err error
+        
+        if strings.HasPrefix(tag, serviceTTLTagPrefix) {
+            // the original TTL tag
+            overrides.TTL, err = parseTTL(strings.TrimPrefix(tag, serviceTTLTagPrefix), updateInterval)
+        } else if strings.HasPrefix(tag, controlTagPrefix) {
+            err = overrides.apply(strings.TrimPrefix(tag, controlTagPrefix), updateInterval)
+        } else {
+            overrides.Tags = append(overrides.Tags, tag)
+            continue
+        }
+        
+        if err != nil {
+            errs = append(errs, fmt.Errorf("invalid tag %s: %v", tag, err))
+        }
+    }
+    
+    return overrides, errs
+}
+
+func (self *eventOverrides) apply(directive string, updateInterval time.Duration) error {
+    if directive == "ignore" {
+        self.Ignore = true
+        return nil
+    }
+    
+    parts := strings.SplitN(directive, "=", 2)
+    if len(parts) != 2 || parts[1] == "" {
+        return fmt.Errorf("expected <name>=<value>")
+    }
+    
+    name, value := parts[0], parts[1]
+    
+    switch {
+        case name == "service":
+            self.Service = value
+        
+        case name == "ttl":
+            ttl, err := parseTTL(value, updateInterval)
+            if err != nil {
+                return err
+            }
+            
+            self.TTL = ttl
+        
+        case strings.HasPrefix(name, "attr.") && len(name) > len("attr."):
+            self.Attributes[strings.TrimPrefix(name, "attr.")] = value
+        
+        default:
+            return fmt.Errorf("unknown directive %s", name)
+    }
+    
+    return nil
+}
+
+// the event service name for one of the service's checks.  a service can have
+// more than one check, so only the one Consul creates along with the service
+// gets the name as-is; the others are distinguished by their check ids.
+func (self *eventOverrides) serviceFor(healthCheck HealthCheck) string {
+    if self.Service == "" {
+        return healthCheck.CheckID
+    }
+    
+    if healthCheck.CheckID == "service:" + healthCheck.ServiceID {
+        return self.Service
+    }
+    
+    return self.Service + " " + healthCheck.CheckID
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "time"
+)
+
+var _ = Describe("service control tags", func() {
+    It("parses control tags and strips them", func() {
+        overrides, errs := parseEventOverrides([]string{
+            "primary",
+            "riemann:service=payments api",
+            "riemann:ttl=5m",
+            "riemann:attr.team=payments",
+            "riemann:attr.runbook=http://wiki/payments",
+            "v2",
+        }, time.Minute)
+        
+        Expect(errs).To(BeEmpty())
+        Expect(overrides.Tags).To(Equal([]string{ "primary", "v2" }))
+        Expect(overrides.Service).To(Equal("payments api"))
+        Expect(overrides.TTL).To(Equal(5 * time.Minute))
+        Expect(overrides.Ignore).To(Equal(false))
+        Expect(overrides.Attributes).To(HaveKeyWithValue("team", "payments"))
+        Expect(overrides.Attributes).To(HaveKeyWithValue("runbook", "http://wiki/payments"))
+    })
+    
+    It("recognizes the riemann-ttl tag", func() {
+        overrides, errs := parseEventOverrides([]string{ "riemann-ttl=300" }, time.Minute)
+        
+        Expect(errs).To(BeEmpty())
+        Expect(overrides.TTL).To(Equal(5 * time.Minute))
+        Expect(overrides.Tags).To(BeEmpty())
+    })
+    
+    It("recognizes riemann:ignore", func() {
+        overrides, _ := parseEventOverrides([]string{ "riemann:ignore" }, time.Minute)
+        
+        Expect(overrides.Ignore).To(Equal(true))
+    })
+    
+    It("reports and strips invalid control tags", func() {
+        overrides, errs := parseEventOverrides([]string{
+            "riemann:ttl=1s",
+            "riemann:colour=blue",
+            "riemann:attr.=x",
+            "riemann:service",
+        }, time.Minute)
+        
+        Expect(errs).To(HaveLen(4))
+        Expect(overrides.Tags).To(BeEmpty())
+        Expect(overrides.TTL).To(Equal(time.Duration(0)))
+    })
+    
+    It("names only the service's own check after the service", func() {
+        overrides, _ := parseEventOverrides([]string{ "riemann:service=payments" }, time.Minute)
+        
+        Expect(overrides.serviceFor(HealthCheck{ CheckID: "service:pay1", ServiceID: "pay1" })).To(Equal("payments"))
+        Expect(overrides.serviceFor(HealthCheck{ CheckID: "pay1-db", ServiceID: "pay1" })).To(Equal("payments pay1-db"))
+    })
+})
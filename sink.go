@@ -0,0 +1,137 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+
+    log "github.com/Sirupsen/logrus"
+)
+
+// Sink receives each batch of health results retrieved while we hold the lock.
+// Open is called when we become the leader and Close when we stop; Send may be
+// called after a failed Open or Send, so implementations that hold a
+// connection should reconnect as needed.
+type Sink interface {
+    Name() string
+    Open() error
+    Send(healthResults []HealthCheck) error
+    Close()
+}
+
+// SinkSet fans each batch out to multiple sinks.  A failing sink doesn't
+// prevent the others from receiving results.
+//
+// observers receive the results like any other sink, but don't deliver them
+// anywhere that matters for failover, so they're left out when deciding
+// whether every sink failed.
+type SinkSet struct {
+    sinks     []Sink
+    observers []Sink
+}
+
+func NewSinkSet(sinks ...Sink) *SinkSet {
+    return &SinkSet{
+        sinks: sinks,
+    }
+}
+
+func (self *SinkSet) Add(sink Sink) {
+    self.sinks = append(self.sinks, sink)
+}
+
+// adds a sink that doesn't count towards the all-sinks-failed check
+func (self *SinkSet) AddObserver(sink Sink) {
+    self.observers = append(self.observers, sink)
+}
+
+func (self *SinkSet) Len() int {
+    return len(self.sinks) + len(self.observers)
+}
+
+// opens all sinks; returns an error only if none could be opened
+func (self *SinkSet) Open() error {
+    failures := 0
+    
+    for _, sink := range self.sinks {
+        if ! self.open(sink) {
+            failures += 1
+        }
+    }
+    
+    for _, sink := range self.observers {
+        self.open(sink)
+    }
+    
+    if failures > 0 && failures == len(self.sinks) {
+        return fmt.Errorf("unable to open any sink")
+    }
+    
+    return nil
+}
+
+// sends the results to all sinks; returns an error only if every sink failed
+func (self *SinkSet) Send(healthResults []HealthCheck) error {
+    failures := 0
+    
+    for _, sink := range self.sinks {
+        if ! self.send(sink, healthResults) {
+            failures += 1
+        }
+    }
+    
+    for _, sink := range self.observers {
+        self.send(sink, healthResults)
+    }
+    
+    if failures > 0 && failures == len(self.sinks) {
+        return fmt.Errorf("all sinks failed")
+    }
+    
+    return nil
+}
+
+// returns false if the sink couldn't be opened
+func (self *SinkSet) open(sink Sink) bool {
+    if err := sink.Open(); err != nil {
+        log.Errorf("unable to open %s sink: %v", sink.Name(), err)
+        metricSinkErrors.Inc(sink.Name())
+        return false
+    }
+    
+    return true
+}
+
+// returns false if the sink failed
+func (self *SinkSet) send(sink Sink, healthResults []HealthCheck) bool {
+    metricSinkBatches.Inc(sink.Name())
+    
+    if err := sink.Send(healthResults); err != nil {
+        log.Errorf("error sending to %s sink: %v", sink.Name(), err)
+        metricSinkErrors.Inc(sink.Name())
+        return false
+    }
+    
+    return true
+}
+
+func (self *SinkSet) Close() {
+    for _, sink := range self.sinks {
+        sink.Close()
+    }
+    
+    for _, sink := range self.observers {
+        sink.Close()
+    }
+}
+
+// splits a sink specification like "file:/var/log/checks.json" into its kind
+// and target.  the target may be empty, as for "riemann".
+func parseSinkSpec(spec string) (string, string) {
+    parts := strings.SplitN(spec, ":", 2)
+    
+    if len(parts) == 1 {
+        return parts[0], ""
+    }
+    
+    return parts[0], parts[1]
+}
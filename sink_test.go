@@ -0,0 +1,109 @@
+package main
+
+import (
+    "fmt"
+)
+
+// records what a SinkSet does with it
+type fakeSink struct {
+    name    string
+    openErr error
+    sendErr error
+    opened  int
+    closed  int
+    batches [][]HealthCheck
+}
+
+func (self *fakeSink) Name() string {
+    return self.name
+}
+
+func (self *fakeSink) Open() error {
+    self.opened += 1
+    return self.openErr
+}
+
+func (self *fakeSink) Send(healthResults []HealthCheck) error {
+    self.batches = append(self.batches, healthResults)
+    return self.sendErr
+}
+
+func (self *fakeSink) Close() {
+    self.closed += 1
+}
+
+var _ = Describe("SinkSet", func() {
+    var sink1 *fakeSink
+    var sink2 *fakeSink
+    var sinks *SinkSet
+    
+    healthResults := []HealthCheck{
+        HealthCheck{ Node: "some-node", CheckID: "serfHealth", Status: "passing" },
+    }
+    
+    BeforeEach(func() {
+        sink1 = &fakeSink{ name: "sink1" }
+        sink2 = &fakeSink{ name: "sink2" }
+        sinks = NewSinkSet(sink1, sink2)
+    })
+    
+    It("sends results to every sink", func() {
+        Expect(sinks.Open()).To(BeNil())
+        Expect(sinks.Send(healthResults)).To(BeNil())
+        
+        Expect(sink1.batches).To(Equal([][]HealthCheck{ healthResults }))
+        Expect(sink2.batches).To(Equal([][]HealthCheck{ healthResults }))
+        
+        sinks.Close()
+        Expect(sink1.closed).To(Equal(1))
+        Expect(sink2.closed).To(Equal(1))
+    })
+    
+    It("tolerates a failing sink", func() {
+        sink1.openErr = fmt.Errorf("nope")
+        sink1.sendErr = fmt.Errorf("nope")
+        
+        Expect(sinks.Open()).To(BeNil())
+        Expect(sinks.Send(healthResults)).To(BeNil())
+        
+        Expect(sink2.batches).To(HaveLen(1))
+    })
+    
+    It("fails when every sink fails", func() {
+        sink1.sendErr = fmt.Errorf("nope")
+        sink2.sendErr = fmt.Errorf("nope")
+        
+        Expect(sinks.Send(healthResults)).NotTo(BeNil())
+    })
+    
+    It("fails when every sink fails, whatever its observers do", func() {
+        observer := &fakeSink{ name: "observer" }
+        sinks.AddObserver(observer)
+        
+        sink1.sendErr = fmt.Errorf("nope")
+        sink2.sendErr = fmt.Errorf("nope")
+        
+        Expect(sinks.Send(healthResults)).NotTo(BeNil())
+        Expect(observer.batches).To(HaveLen(1))
+        
+        sinks.Close()
+        Expect(observer.closed).To(Equal(1))
+    })
+    
+    It("fails to open when every sink fails to open", func() {
+        sink1.openErr = fmt.Errorf("nope")
+        sink2.openErr = fmt.Errorf("nope")
+        
+        Expect(sinks.Open()).NotTo(BeNil())
+    })
+    
+    It("parses sink specifications", func() {
+        kind, target := parseSinkSpec("riemann")
+        Expect(kind).To(Equal("riemann"))
+        Expect(target).To(Equal(""))
+        
+        kind, target = parseSinkSpec("webhook:http://example.com:8080/checks")
+        Expect(kind).To(Equal("webhook"))
+        Expect(target).To(Equal("http://example.com:8080/checks"))
+    })
+})
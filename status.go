@@ -0,0 +1,61 @@
+package main
+
+import (
+    "sync"
+    "net/http"
+    "encoding/json"
+
+    log "github.com/Sirupsen/logrus"
+)
+
+// StatusRegistry collects the status of the receiver's components and serves
+// them as a single JSON document.  Each component registers a function that
+// returns its current status; they're invoked on every request.
+type StatusRegistry struct {
+    lock      sync.RWMutex
+    providers map[string]func() interface{}
+}
+
+func NewStatusRegistry() *StatusRegistry {
+    return &StatusRegistry{
+        providers: make(map[string]func() interface{}),
+    }
+}
+
+func (self *StatusRegistry) Register(name string, provider func() interface{}) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    
+    self.providers[name] = provider
+}
+
+// returns a snapshot of all registered statuses
+func (self *StatusRegistry) Status() map[string]interface{} {
+    self.lock.RLock()
+    defer self.lock.RUnlock()
+    
+    status := make(map[string]interface{})
+    for name, provider := range self.providers {
+        status[name] = provider()
+    }
+    
+    return status
+}
+
+func (self *StatusRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, self.Status())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+    body, err := json.MarshalIndent(v, "", "    ")
+    
+    if err != nil {
+        log.Errorf("unable to encode response: %v", err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(body)
+    w.Write([]byte("\n"))
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+    "fmt"
+    "time"
+    "bytes"
+    "strings"
+    "sync"
+    "net/http"
+    "io/ioutil"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "text/template"
+
+    log "github.com/Sirupsen/logrus"
+)
+
+// TransitionWebhookSink POSTs to a URL whenever a check changes state, either
+// one request per transition or one request per batch of health results.  The
+// first batch after becoming the leader only establishes the baseline, so a
+// change of leadership doesn't produce a flood of spurious transitions.
+//
+// requests are made by a goroutine working through a bounded queue, so a slow
+// or dead webhook can't hold up the other sinks or the lock handling.
+type TransitionWebhookSink struct {
+    config   TransitionWebhookConfig
+    nodeName string
+    dc       string
+    client   *http.Client
+    
+    // last status of each check handed to the queue, keyed by node and check
+    // id; guarded by lock, since failed deliveries are rolled back by the
+    // delivery goroutine
+    lock     sync.Mutex
+    statuses map[nodeCheckKey]string
+    
+    queue chan transitionDelivery
+    stop  chan interface{}
+    wg    sync.WaitGroup
+}
+
+type TransitionWebhookConfig struct {
+    URL        string
+    Headers    http.Header
+    
+    // if nil, the payload is sent as JSON
+    Template   *template.Template
+    
+    // retries after the first attempt; the delay doubles after each one
+    Retries    int
+    RetryDelay time.Duration
+    
+    // how long to keep retrying a request before giving up, regardless of
+    // Retries; unlimited if zero
+    RetryBudget time.Duration
+    
+    // if not empty, the body is signed with HMAC-SHA256 and the signature
+    // sent as "X-Signature: sha256=<hex>"
+    Secret     string
+    
+    // send all of a batch's transitions in a single request
+    Batch      bool
+    
+    // of each request
+    Timeout    time.Duration
+    
+    // requests waiting to be made; when full, new transitions are dropped
+    // and tried again with the next batch
+    QueueSize  int
+}
+
+type nodeCheckKey struct {
+    Node    string
+    CheckID string
+}
+
+// a single check state change; the payload for each request, or the template
+// data, when not batching
+type checkTransition struct {
+    Time           time.Time
+    ReportingNode  string
+    Datacenter     string
+    PreviousStatus string
+    HealthCheck
+}
+
+// the payload for each request, or the template data, when batching
+type checkTransitionBatch struct {
+    Time          time.Time
+    ReportingNode string
+    Datacenter    string
+    Transitions   []checkTransition
+}
+
+// a queued request and the transitions it carries
+type transitionDelivery struct {
+    payload     interface{}
+    transitions []checkTransition
+}
+
+func NewTransitionWebhookSink(config TransitionWebhookConfig, nodeName, dc string) *TransitionWebhookSink {
+    if config.QueueSize < 1 {
+        config.QueueSize = 1
+    }
+    
+    return &TransitionWebhookSink{
+        config:   config,
+        nodeName: nodeName,
+        dc:       dc,
+        client:   &http.Client{
+            Timeout: config.Timeout,
+        },
+    }
+}
+
+func (self *TransitionWebhookSink) Name() string {
+    return "transitions"
+}
+
+func (self *TransitionWebhookSink) Open() error {
+    self.lock.Lock()
+    self.statuses = nil
+    self.lock.Unlock()
+    
+    self.queue = make(chan transitionDelivery, self.config.QueueSize)
+    self.stop = make(chan interface{})
+    
+    self.wg.Add(1)
+    go self.deliver(self.queue, self.stop)
+    
+    return nil
+}
+
+func (self *TransitionWebhookSink) Send(healthResults []HealthCheck) error {
+    now := time.Now()
+    
+    self.lock.Lock()
+    
+    baseline := self.statuses == nil
+    if baseline {
+        self.statuses = make(map[nodeCheckKey]string)
+    }
+    
+    var transitions []checkTransition
+    
+    for _, healthCheck := range healthResults {
+        key := nodeCheckKey{ healthCheck.Node, healthCheck.CheckID }
+        previous, known := self.statuses[key]
+        
+        if ! baseline && known && previous != healthCheck.Status {
+            transitions = append(transitions, checkTransition{
+                Time:           now,
+                ReportingNode:  self.nodeName,
+                Datacenter:     self.dc,
+                PreviousStatus: previous,
+                HealthCheck:    healthCheck,
+            })
+        }
+        
+        self.statuses[key] = healthCheck.Status
+    }
+    
+    self.lock.Unlock()
+    
+    if len(transitions) == 0 {
+        return nil
+    }
+    
+    var deliveries []transitionDelivery
+    
+    if self.config.Batch {
+        deliveries = append(deliveries, transitionDelivery{
+            payload:     checkTransitionBatch{
+                Time:          now,
+                ReportingNode: self.nodeName,
+                Datacenter:    self.dc,
+                Transitions:   transitions,
+            },
+            transitions: transitions,
+        })
+    } else {
+        for _, transition := range transitions {
+            deliveries = append(deliveries, transitionDelivery{
+                payload:     transition,
+                transitions: []checkTransition{ transition },
+            })
+        }
+    }
+    
+    dropped := 0
+    
+    for _, delivery := range deliveries {
+        select {
+            case self.queue <- delivery:
+            
+            default:
+                self.rollBack(delivery.transitions)
+                dropped += len(delivery.transitions)
+        }
+    }
+    
+    if dropped > 0 {
+        return fmt.Errorf("transition queue full; %d of %d transitions will be tried again", dropped, len(transitions))
+    }
+    
+    return nil
+}
+
+// stops delivering; queued requests are abandoned
+func (self *TransitionWebhookSink) Close() {
+    if self.stop != nil {
+        close(self.stop)
+        self.wg.Wait()
+        
+        self.stop = nil
+        self.queue = nil
+    }
+    
+    self.lock.Lock()
+    self.statuses = nil
+    self.lock.Unlock()
+}
+
+// makes the queued requests until stop is closed
+func (self *TransitionWebhookSink) deliver(queue <-chan transitionDelivery, stop <-chan interface{}) {
+    defer self.wg.Done()
+    defer recoverAndLog("TransitionWebhookSink.deliver")
+    
+    for {
+        select {
+            case <-stop:
+                return
+            
+            case delivery := <-queue:
+                if err := self.post(delivery.payload, stop); err != nil {
+                    log.Errorf("unable to deliver %d transition(s): %v", len(delivery.transitions), err)
+                    metricSinkErrors.Inc(self.Name())
+                    
+                    self.rollBack(delivery.transitions)
+                }
+        }
+    }
+}
+
+// forgets that undelivered transitions happened, so they're found again in
+// the next batch, unless the check has changed again since
+func (self *TransitionWebhookSink) rollBack(transitions []checkTransition) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    
+    if self.statuses == nil {
+        return
+    }
+    
+    for _, transition := range transitions {
+        key := nodeCheckKey{ transition.Node, transition.CheckID }
+        
+        if self.statuses[key] == transition.Status {
+            self.statuses[key] = transition.PreviousStatus
+        }
+    }
+}
+
+// renders the payload and POSTs it, retrying on connection errors and 5xx
+// responses until the retries or the retry budget run out, or stop is closed
+func (self *TransitionWebhookSink) post(payload interface{}, stop <-chan interface{}) error {
+    body, err := self.render(payload)
+    if err != nil {
+        return err
+    }
+    
+    delay := self.config.RetryDelay
+    
+    var deadline time.Time
+    if self.config.RetryBudget > 0 {
+        deadline = time.Now().Add(self.config.RetryBudget)
+    }
+    
+    for attempt := 0; ; attempt++ {
+        var retryable bool
+        retryable, err = self.postOnce(body)
+        
+        if err == nil || ! retryable || attempt >= self.config.Retries {
+            return err
+        }
+        
+        if ! deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+            return fmt.Errorf("gave up retrying after %s: %v", self.config.RetryBudget, err)
+        }
+        
+        log.Warnf("transition webhook failed, retrying in %s: %v", delay, err)
+        
+        select {
+            case <-stop:
+                return err
+            
+            case <-time.After(delay):
+        }
+        
+        delay *= 2
+    }
+}
+
+func (self *TransitionWebhookSink) postOnce(body []byte) (bool, error) {
+    req, err := http.NewRequest("POST", self.config.URL, bytes.NewReader(body))
+    if err != nil {
+        return false, err
+    }
+    
+    req.Header.Set("Content-Type", "application/json")
+    
+    for name, values := range self.config.Headers {
+        req.Header.Del(name)
+        
+        for _, value := range values {
+            req.Header.Add(name, value)
+        }
+    }
+    
+    if self.config.Secret != "" {
+        req.Header.Set("X-Signature", "sha256=" + signPayload(self.config.Secret, body))
+    }
+    
+    resp, err := self.client.Do(req)
+    if err != nil {
+        return true, err
+    }
+    
+    ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return resp.StatusCode >= 500, fmt.Errorf("unexpected response from %s: %s", self.config.URL, resp.Status)
+    }
+    
+    return false, nil
+}
+
+func (self *TransitionWebhookSink) render(payload interface{}) ([]byte, error) {
+    if self.config.Template == nil {
+        return json.Marshal(payload)
+    }
+    
+    var buf bytes.Buffer
+    
+    if err := self.config.Template.Execute(&buf, payload); err != nil {
+        return nil, err
+    }
+    
+    return buf.Bytes(), nil
+}
+
+// hex-encoded HMAC-SHA256 of the body
+func signPayload(secret string, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write(body)
+    
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parses a body template for the transition webhook.  in addition to the
+// usual functions, "json" renders its argument as JSON.
+func parseTransitionTemplate(name, text string) (*template.Template, error) {
+    return template.New(name).Funcs(template.FuncMap{
+        "json": func(v interface{}) (string, error) {
+            b, err := json.Marshal(v)
+            return string(b), err
+        },
+    }).Parse(text)
+}
+
+// parses headers given as "Name: value"
+func parseHeaders(specs []string) (http.Header, error) {
+    headers := make(http.Header)
+    
+    for _, spec := range specs {
+        parts := strings.SplitN(spec, ":", 2)
+        
+        if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+            return nil, fmt.Errorf("invalid header %q; expected Name: value", spec)
+        }
+        
+        headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+    }
+    
+    return headers, nil
+}
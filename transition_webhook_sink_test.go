@@ -0,0 +1,262 @@
+package main
+
+import (
+    "sync"
+    "net/http"
+    "net/http/httptest"
+    "io/ioutil"
+    "encoding/json"
+    "time"
+)
+
+var _ = Describe("TransitionWebhookSink", func() {
+    var server *httptest.Server
+    var lock sync.Mutex
+    var requests []*http.Request
+    var bodies []string
+    var statuses []int
+    var delay time.Duration
+    var config TransitionWebhookConfig
+    var sink *TransitionWebhookSink
+    
+    // the requests received so far, and their bodies
+    received := func() int {
+        lock.Lock()
+        defer lock.Unlock()
+        
+        return len(requests)
+    }
+    
+    body := func(i int) string {
+        lock.Lock()
+        defer lock.Unlock()
+        
+        return bodies[i]
+    }
+    
+    header := func(i int, name string) string {
+        lock.Lock()
+        defer lock.Unlock()
+        
+        return requests[i].Header.Get(name)
+    }
+    
+    BeforeEach(func() {
+        requests = nil
+        bodies = nil
+        statuses = nil
+        delay = 0
+        sink = nil
+        
+        server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            body, _ := ioutil.ReadAll(r.Body)
+            
+            lock.Lock()
+            
+            requests = append(requests, r)
+            bodies = append(bodies, string(body))
+            
+            // respond with the queued statuses, then 200
+            status := http.StatusOK
+            if len(statuses) > 0 {
+                status = statuses[0]
+                statuses = statuses[1:]
+            }
+            
+            wait := delay
+            
+            lock.Unlock()
+            
+            time.Sleep(wait)
+            w.WriteHeader(status)
+        }))
+        
+        config = TransitionWebhookConfig{
+            URL:        server.URL,
+            RetryDelay: time.Millisecond,
+            Timeout:    time.Second,
+            QueueSize:  10,
+        }
+    })
+    
+    AfterEach(func() {
+        if sink != nil {
+            sink.Close()
+        }
+        
+        server.Close()
+    })
+    
+    check := func(node, status string) HealthCheck {
+        return HealthCheck{ Node: node, CheckID: "serfHealth", Status: status }
+    }
+    
+    It("posts nothing for the baseline", func() {
+        sink = NewTransitionWebhookSink(config, "reporting-node", "dc1")
+        
+        Expect(sink.Open()).To(BeNil())
+        Expect(sink.Send([]HealthCheck{ check("node1", "passing") })).To(BeNil())
+        Expect(sink.Send([]HealthCheck{ check("node1", "passing") })).To(BeNil())
+        
+        Consistently(received, "50ms").Should(Equal(0))
+    })
+    
+    It("posts each transition as JSON", func() {
+        sink = NewTransitionWebhookSink(config, "reporting-node", "dc1")
+        
+        sink.Open()
+        sink.Send([]HealthCheck{ check("node1", "passing"), check("node2", "passing") })
+        
+        Expect(sink.Send([]HealthCheck{ check("node1", "critical"), check("node2", "warning") })).To(BeNil())
+        Eventually(received).Should(Equal(2))
+        Expect(header(0, "Content-Type")).To(Equal("application/json"))
+        
+        var transition checkTransition
+        Expect(json.Unmarshal([]byte(body(0)), &transition)).To(BeNil())
+        Expect(transition.Node).To(Equal("node1"))
+        Expect(transition.PreviousStatus).To(Equal("passing"))
+        Expect(transition.Status).To(Equal("critical"))
+        Expect(transition.ReportingNode).To(Equal("reporting-node"))
+        Expect(transition.Datacenter).To(Equal("dc1"))
+    })
+    
+    It("batches transitions", func() {
+        config.Batch = true
+        sink = NewTransitionWebhookSink(config, "reporting-node", "dc1")
+        
+        sink.Open()
+        sink.Send([]HealthCheck{ check("node1", "passing"), check("node2", "passing") })
+        sink.Send([]HealthCheck{ check("node1", "critical"), check("node2", "warning") })
+        
+        Eventually(received).Should(Equal(1))
+        
+        var batch checkTransitionBatch
+        Expect(json.Unmarshal([]byte(body(0)), &batch)).To(BeNil())
+        Expect(batch.Transitions).To(HaveLen(2))
+    })
+    
+    It("sends configured headers and renders the template", func() {
+        config.Headers, _ = parseHeaders([]string{ "Authorization: Bearer abc123", "Content-Type: text/plain" })
+        config.Template, _ = parseTransitionTemplate("test", `{{.Node}} is now {{.Status}} (was {{.PreviousStatus}}) {{json .Tags}}`)
+        sink = NewTransitionWebhookSink(config, "reporting-node", "dc1")
+        
+        sink.Open()
+        sink.Send([]HealthCheck{ check("node1", "passing") })
+        sink.Send([]HealthCheck{ check("node1", "critical") })
+        
+        Eventually(received).Should(Equal(1))
+        Expect(header(0, "Authorization")).To(Equal("Bearer abc123"))
+        Expect(header(0, "Content-Type")).To(Equal("text/plain"))
+        Expect(body(0)).To(Equal("node1 is now critical (was passing) null"))
+    })
+    
+    It("signs the body", func() {
+        config.Secret = "s3kr1t"
+        sink = NewTransitionWebhookSink(config, "reporting-node", "dc1")
+        
+        sink.Open()
+        sink.Send([]HealthCheck{ check("node1", "passing") })
+        sink.Send([]HealthCheck{ check("node1", "critical") })
+        
+        Eventually(received).Should(Equal(1))
+        Expect(header(0, "X-Signature")).To(Equal("sha256=" + signPayload("s3kr1t", []byte(body(0)))))
+        Expect(header(0, "X-Signature")).To(MatchRegexp(`^sha256=[0-9a-f]{64}$`))
+    })
+    
+    It("retries server errors", func() {
+        config.Retries = 2
+        statuses = []int{ 503, 502 }
+        sink = NewTransitionWebhookSink(config, "reporting-node", "dc1")
+        
+        sink.Open()
+        sink.Send([]HealthCheck{ check("node1", "passing") })
+        
+        Expect(sink.Send([]HealthCheck{ check("node1", "critical") })).To(BeNil())
+        Eventually(received).Should(Equal(3))
+        Consistently(received, "50ms").Should(Equal(3))
+    })
+    
+    It("gives up after the configured retries and tries again next time", func() {
+        config.Retries = 1
+        statuses = []int{ 500, 500 }
+        sink = NewTransitionWebhookSink(config, "reporting-node", "dc1")
+        
+        sink.Open()
+        sink.Send([]HealthCheck{ check("node1", "passing") })
+        
+        Expect(sink.Send([]HealthCheck{ check("node1", "critical") })).To(BeNil())
+        Eventually(received).Should(Equal(2))
+        
+        // the transition wasn't delivered, so it's found again
+        Eventually(func() int {
+            sink.Send([]HealthCheck{ check("node1", "critical") })
+            return received()
+        }).Should(Equal(3))
+    })
+    
+    It("stops retrying when the retry budget runs out", func() {
+        config.Retries = 10
+        config.RetryDelay = 20 * time.Millisecond
+        config.RetryBudget = 50 * time.Millisecond
+        statuses = []int{ 500, 500, 500, 500, 500, 500 }
+        sink = NewTransitionWebhookSink(config, "reporting-node", "dc1")
+        
+        sink.Open()
+        sink.Send([]HealthCheck{ check("node1", "passing") })
+        sink.Send([]HealthCheck{ check("node1", "critical") })
+        
+        // at 0 and 20ms; the next, at 60ms, would be past the budget
+        Eventually(received).Should(Equal(2))
+        Consistently(received, "200ms").Should(Equal(2))
+    })
+    
+    It("doesn't retry client errors", func() {
+        config.Retries = 3
+        statuses = []int{ 400 }
+        sink = NewTransitionWebhookSink(config, "reporting-node", "dc1")
+        
+        sink.Open()
+        sink.Send([]HealthCheck{ check("node1", "passing") })
+        sink.Send([]HealthCheck{ check("node1", "critical") })
+        
+        Eventually(received).Should(Equal(1))
+        Consistently(received, "50ms").Should(Equal(1))
+    })
+    
+    It("doesn't wait for a slow webhook", func() {
+        delay = 500 * time.Millisecond
+        sink = NewTransitionWebhookSink(config, "reporting-node", "dc1")
+        
+        sink.Open()
+        sink.Send([]HealthCheck{ check("node1", "passing"), check("node2", "passing") })
+        
+        start := time.Now()
+        Expect(sink.Send([]HealthCheck{ check("node1", "critical"), check("node2", "critical") })).To(BeNil())
+        Expect(time.Since(start)).To(BeNumerically("<", 100 * time.Millisecond))
+    })
+    
+    It("drops transitions when the queue is full, to be found again", func() {
+        delay = 200 * time.Millisecond
+        config.QueueSize = 1
+        sink = NewTransitionWebhookSink(config, "reporting-node", "dc1")
+        
+        sink.Open()
+        sink.Send([]HealthCheck{ check("node1", "passing"), check("node2", "passing"), check("node3", "passing") })
+        
+        // one being delivered, one queued, and one that doesn't fit
+        Expect(sink.Send([]HealthCheck{ check("node1", "critical") })).To(BeNil())
+        Eventually(received).Should(Equal(1))
+        
+        Expect(sink.Send([]HealthCheck{ check("node1", "critical"), check("node2", "critical"), check("node3", "critical") })).NotTo(BeNil())
+        
+        Eventually(func() int {
+            sink.Send([]HealthCheck{ check("node1", "critical"), check("node2", "critical"), check("node3", "critical") })
+            return received()
+        }, "2s").Should(Equal(3))
+    })
+    
+    It("rejects malformed headers", func() {
+        _, err := parseHeaders([]string{ "no-colon" })
+        Expect(err).NotTo(BeNil())
+    })
+})
@@ -0,0 +1,56 @@
+package main
+
+import (
+    "fmt"
+    "time"
+    "strings"
+    "strconv"
+)
+
+// tag on a Consul service that overrides the TTL of the Riemann events for its
+// checks, e.g. riemann-ttl=300 (seconds) or riemann-ttl=5m.  equivalent to
+// riemann:ttl=...; see service_tags.go.
+const serviceTTLTagPrefix = "riemann-ttl="
+
+// parses a TTL given either as a multiple of the update interval, like "3x",
+// or as a duration, like "90s".  results come in at least once per update
+// interval, so the TTL must be longer than that.
+func parseTTL(spec string, updateInterval time.Duration) (time.Duration, error) {
+    var ttl time.Duration
+    
+    if strings.HasSuffix(spec, "x") {
+        multiplier, err := strconv.ParseFloat(strings.TrimSuffix(spec, "x"), 64)
+        if err != nil {
+            return 0, fmt.Errorf("invalid TTL multiplier %s", spec)
+        }
+        
+        ttl = time.Duration(float64(updateInterval) * multiplier)
+    } else {
+        var err error
+        
+        ttl, err = parseSecondsOrDuration(spec)
+        if err != nil {
+            return 0, fmt.Errorf("invalid TTL %s", spec)
+        }
+    }
+    
+    if ttl <= updateInterval {
+        return 0, fmt.Errorf("TTL %s must be greater than the update interval, %s", ttl, updateInterval)
+    }
+    
+    return ttl, nil
+}
+
+// a plain number is taken as seconds
+func parseSecondsOrDuration(spec string) (time.Duration, error) {
+    if seconds, err := strconv.ParseFloat(spec, 64); err == nil {
+        return time.Duration(seconds * float64(time.Second)), nil
+    }
+    
+    return time.ParseDuration(spec)
+}
+
+// Riemann TTLs are floating-point seconds
+func riemannTTL(ttl time.Duration) float32 {
+    return float32(ttl.Seconds())
+}
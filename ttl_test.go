@@ -0,0 +1,39 @@
+package main
+
+import (
+    "time"
+)
+
+var _ = Describe("TTLs", func() {
+    It("parses a multiple of the update interval", func() {
+        ttl, err := parseTTL("2.5x", time.Minute)
+        Expect(err).To(BeNil())
+        Expect(ttl).To(Equal(150 * time.Second))
+    })
+    
+    It("parses a duration or seconds", func() {
+        ttl, err := parseTTL("5m", time.Minute)
+        Expect(err).To(BeNil())
+        Expect(ttl).To(Equal(5 * time.Minute))
+        
+        ttl, err = parseTTL("300", time.Minute)
+        Expect(err).To(BeNil())
+        Expect(ttl).To(Equal(5 * time.Minute))
+    })
+    
+    It("rejects a TTL that doesn't exceed the update interval", func() {
+        _, err := parseTTL("1x", time.Minute)
+        Expect(err).NotTo(BeNil())
+        
+        _, err = parseTTL("30s", time.Minute)
+        Expect(err).NotTo(BeNil())
+    })
+    
+    It("rejects garbage", func() {
+        _, err := parseTTL("forever", time.Minute)
+        Expect(err).NotTo(BeNil())
+        
+        _, err = parseTTL("manyx", time.Minute)
+        Expect(err).NotTo(BeNil())
+    })
+})
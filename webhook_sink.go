@@ -0,0 +1,79 @@
+package main
+
+import (
+    "fmt"
+    "time"
+    "bytes"
+    "net/http"
+    "io/ioutil"
+    "encoding/json"
+)
+
+// WebhookSink POSTs each batch of health results to a URL as JSON.
+type WebhookSink struct {
+    url          string
+    nodeName     string
+    dc           string
+    fencingToken func() uint64
+    client       *http.Client
+}
+
+type webhookBatch struct {
+    Time          time.Time
+    ReportingNode string
+    Datacenter    string
+    FencingToken  uint64
+    HealthChecks  []HealthCheck
+}
+
+func NewWebhookSink(url string, timeout time.Duration, nodeName, dc string, fencingToken func() uint64) *WebhookSink {
+    return &WebhookSink{
+        url:          url,
+        nodeName:     nodeName,
+        dc:           dc,
+        fencingToken: fencingToken,
+        client:       &http.Client{
+            Timeout: timeout,
+        },
+    }
+}
+
+func (self *WebhookSink) Name() string {
+    return "webhook"
+}
+
+func (self *WebhookSink) Open() error {
+    return nil
+}
+
+func (self *WebhookSink) Send(healthResults []HealthCheck) error {
+    body, err := json.Marshal(webhookBatch{
+        Time:          time.Now(),
+        ReportingNode: self.nodeName,
+        Datacenter:    self.dc,
+        FencingToken:  self.fencingToken(),
+        HealthChecks:  healthResults,
+    })
+    
+    if err != nil {
+        return err
+    }
+    
+    resp, err := self.client.Post(self.url, "application/json", bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    
+    // read the body so the connection can be reused
+    ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return fmt.Errorf("unexpected response from %s: %s", self.url, resp.Status)
+    }
+    
+    return nil
+}
+
+func (self *WebhookSink) Close() {
+}
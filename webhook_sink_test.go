@@ -0,0 +1,58 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "encoding/json"
+    "time"
+)
+
+var _ = Describe("WebhookSink", func() {
+    var server *httptest.Server
+    var received []webhookBatch
+    var status int
+    
+    BeforeEach(func() {
+        received = nil
+        status = http.StatusOK
+        
+        server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            var batch webhookBatch
+            json.NewDecoder(r.Body).Decode(&batch)
+            received = append(received, batch)
+            
+            w.WriteHeader(status)
+        }))
+    })
+    
+    AfterEach(func() {
+        server.Close()
+    })
+    
+    fencingToken := func() uint64 {
+        return 42
+    }
+    
+    It("posts the batch as JSON", func() {
+        sink := NewWebhookSink(server.URL, time.Second, "reporting-node", "dc1", fencingToken)
+        
+        err := sink.Send([]HealthCheck{
+            HealthCheck{ Node: "some-node", CheckID: "serfHealth", Status: "passing" },
+        })
+        
+        Expect(err).To(BeNil())
+        Expect(received).To(HaveLen(1))
+        Expect(received[0].ReportingNode).To(Equal("reporting-node"))
+        Expect(received[0].Datacenter).To(Equal("dc1"))
+        Expect(received[0].FencingToken).To(Equal(uint64(42)))
+        Expect(received[0].HealthChecks).To(HaveLen(1))
+        Expect(received[0].HealthChecks[0].Node).To(Equal("some-node"))
+    })
+    
+    It("fails on a non-2xx response", func() {
+        status = http.StatusInternalServerError
+        sink := NewWebhookSink(server.URL, time.Second, "reporting-node", "dc1", fencingToken)
+        
+        Expect(sink.Send([]HealthCheck{})).NotTo(BeNil())
+    })
+})